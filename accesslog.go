@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Access log
+//
+// Unlike the operational log, the access log has one machine-readable record for every request
+// a client sends, every response broadcast to clients, and every reply to a tagged request, which
+// only goes to the client that sent it (see tags.go), for auditing.
+//
+
+// One access log record. Broadcast responses have no client.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	ClientID  uint64    `json:"client_id,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	Word      string    `json:"word"`
+}
+
+// Access log formats: JSON lines, or tab-separated text.
+var ACCESS_LOG_FORMATS = []string{"json", "text"}
+
+// Writes access records to w, in format (one of ACCESS_LOG_FORMATS).
+// A nil accessLogger logs nothing, so the hub needn't check whether access logging is on.
+// Only used from within runListener's loop.
+type accessLogger struct {
+	w      io.WriteCloser
+	format string
+}
+
+// Opens the access log at path, appending to it, or stdout if path is "-".
+func openAccessLog(path string, format string) (*accessLogger, error) {
+	if !containsString(ACCESS_LOG_FORMATS, format) {
+		return nil, fmt.Errorf("Unknown access log format %q", format)
+	}
+	if path == "-" {
+		return &accessLogger{w: nopCloser{os.Stdout}, format: format}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{w: f, format: format}, nil
+}
+
+// Closes the access log, unless it is stdout.
+func (l *accessLogger) Close() error {
+	return l.w.Close()
+}
+
+// Stops stdout being closed along with the access log.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (l *accessLogger) write(r accessRecord) {
+	if l.format == "json" {
+		json.NewEncoder(l.w).Encode(r)
+		return
+	}
+	fields := []string{r.Time.Format(time.RFC3339Nano), r.Direction, "-", "-", r.Word}
+	if r.ClientID != 0 {
+		fields[2], fields[3] = fmt.Sprint(r.ClientID), r.Addr
+	}
+	fmt.Fprintln(l.w, strings.Join(fields, "\t"))
+}
+
+// Records a request from c, given as its words.
+func (l *accessLogger) logRequest(c *Client, words []string) {
+	if l == nil || len(words) == 0 {
+		return
+	}
+	l.write(accessRecord{time.Now(), "request", c.id, c.RemoteAddr().String(), words[0]})
+}
+
+// Records a response sent to c, or broadcast to all clients if c is nil.
+func (l *accessLogger) logResponse(c *Client, res baps3.Message) {
+	if l == nil {
+		return
+	}
+	r := accessRecord{Time: time.Now(), Direction: "response", Word: res.Word().String()}
+	if c != nil {
+		r.ClientID, r.Addr = c.id, c.RemoteAddr().String()
+	}
+	l.write(r)
+}
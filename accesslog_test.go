@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	h := makeTestHub()
+	c, other := makeTestClient(h)
+	defer other.Close()
+	var buf bytes.Buffer
+	l := &accessLogger{w: nopCloser{&buf}, format: "json"}
+
+	l.logRequest(c, []string{"play"})
+	l.logResponse(nil, *baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+	l.logResponse(c, *baps3.NewMessage(baps3.RsOk).AddArg("play"))
+
+	scanner := bufio.NewScanner(&buf)
+	var records []accessRecord
+	for scanner.Scan() {
+		var r accessRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("TestAccessLogJSON: returned err on unmarshal (%s)", err.Error())
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf("TestAccessLogJSON: got %d records, want 3", len(records))
+	}
+	if r := records[0]; r.Direction != "request" || r.ClientID != c.id || r.Word != "play" {
+		t.Errorf("TestAccessLogJSON: got request record %+v", r)
+	}
+	if r := records[1]; r.Direction != "response" || r.ClientID != 0 || r.Word != "STATE" {
+		t.Errorf("TestAccessLogJSON: got response record %+v", r)
+	}
+	if r := records[2]; r.Direction != "response" || r.ClientID != c.id || r.Word != "OK" {
+		t.Errorf("TestAccessLogJSON: got reply record %+v", r)
+	}
+}
+
+func TestAccessLogNil(t *testing.T) {
+	// Logging to no access log does nothing, rather than panicking
+	var l *accessLogger
+	l.logResponse(nil, *baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+}
+
+func TestAccessLogText(t *testing.T) {
+	var buf bytes.Buffer
+	l := &accessLogger{w: nopCloser{&buf}, format: "text"}
+	l.logResponse(nil, *baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+
+	fields := strings.Split(strings.TrimSpace(buf.String()), "\t")
+	if len(fields) != 5 || fields[1] != "response" || fields[4] != "STATE" {
+		t.Errorf("TestAccessLogText: got %q", buf.String())
+	}
+}
+
+// The hub logs what it broadcasts itself, with no client, and tagged replies, with the client
+// they go to.
+func TestAccessLogHub(t *testing.T) {
+	h := makeTestHub()
+	c, other := makeTestClient(h)
+	defer other.Close()
+	var buf bytes.Buffer
+	h.accessLog = &accessLogger{w: nopCloser{&buf}, format: "json"}
+
+	h.broadcast(*baps3.NewMessage(baps3.RsSelect).AddArg("0"))
+	h.sendTagged(c, "7", *baps3.NewMessage(baps3.RsOk).AddArg("play"))
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range []accessRecord{{Word: "SELECT"}, {ClientID: c.id, Word: "OK"}} {
+		var r accessRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("TestAccessLogHub: returned err on decode (%s)", err.Error())
+		}
+		if r.Direction != "response" || r.ClientID != want.ClientID || r.Word != want.Word {
+			t.Errorf("TestAccessLogHub: got %+v, want %s to client %d", r, want.Word, want.ClientID)
+		}
+	}
+}
@@ -2,69 +2,540 @@ package main
 
 import (
 	"bufio"
-	"log"
+	"bytes"
+	"context"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	baps3 "github.com/UniversityRadioYork/baps3-go"
 )
 
+// The last client ID handed out. Only ever accessed atomically.
+var lastClientID uint64
+
+// Returns a new, unique client ID. Safe to call from concurrent goroutines.
+func nextClientID() uint64 {
+	return atomic.AddUint64(&lastClientID, 1)
+}
+
+// A response to send to a client, along with its packed form, so a response broadcast to every
+// client is only packed once rather than once per client. lowPriority is whether it goes on the
+// client's lowCh rather than its resCh, and dedup whether it's dropped for clients that were
+// just sent the same thing.
+type response struct {
+	baps3.Message
+	packed      []byte
+	lowPriority bool
+	dedup       bool
+	// Where it comes in the server's broadcasts, for clients with wantsSeq, or 0 if it isn't one.
+	seq uint64
+	// If not nil, this is a burst of responses rather than one, and the rest is unset (see
+	// hub.packBurst). However many it has, a burst only takes up one place in a client's buffer.
+	burst []response
+}
+
+// Packs msg into a response.
+func packResponse(msg baps3.Message) (response, error) {
+	packed, err := msg.Pack()
+	return response{Message: msg, packed: packed}, err
+}
+
 // Wrapper structure for a client connection. The actual connection is stored in conn,
-// resCh is a channel that responses get sent down and tok is the tokeniser for
-// converting newly received data into baps3.Messages.
+// resCh is a channel that responses get sent down, lowCh one for responses that can wait until
+// resCh is empty, and tok is the tokeniser for converting newly received data into baps3.Messages. id identifies the client in logs,
+// and connected is when it connected.
+// If readTimeout is non-zero, the client is disconnected after sending nothing for that long;
+// if writeTimeout is non-zero, it is disconnected if writing one response takes longer.
+// lastActivity is the UnixNano time of the last successful read or write, and dropped the number
+// of responses the hub couldn't deliver; removed is 1 once the hub has unregistered the client.
+// requests and responses count what the client has sent and been sent.
+// All five are accessed atomically.
+// Log messages go to logger. user is who the client authenticated as, if anyone, and failedAuths
+// how many times it has failed to; limiter (if not nil) restricts how often it can send requests,
+// wantsTime is whether it is sent TIME responses, wantsSeq whether broadcasts it is sent start
+// with their sequence numbers, and lastSent the last response it was sent with each of the
+// config's DedupResponses words. These are only touched by the hub.
 type Client struct {
-	conn  net.Conn
-	resCh chan baps3.Message
-	tok   *baps3.Tokeniser
+	id           uint64
+	connected    time.Time
+	conn         net.Conn
+	logger       Logger
+	resCh        chan response
+	lowCh        chan response
+	tok          *baps3.Tokeniser
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	lastActivity int64
+	dropped      uint64
+	requests     uint64
+	responses    uint64
+	removed      int32
+	user         string
+	failedAuths  int
+	limiter      *tokenBucket
+	wantsTime    bool
+	wantsSeq     bool
+	lastSent     map[baps3.MessageWord][]byte
+
+	// Only touched by Read.
+	badRequests    int
+	maxBadRequests int
+	maxLineLength  int
+	maxArgs        int
+
+	// Only touched by Write. shaper, if not nil, limits how fast responses are written; if
+	// dropShaped, those over the limit are dropped rather than held back, and counted in
+	// shapedBytes, which is accessed atomically.
+	shaper      *tokenBucket
+	dropShaped  bool
+	shapedBytes uint64
+}
+
+// Readers left over from clients that have disconnected, for new clients to reuse rather than
+// allocating a maxLineLength buffer each. Holds *bufio.Readers.
+var readerPool sync.Pool
+
+// Gets a reader of conn with a size-byte buffer, from readerPool if there's one that size.
+func getReader(conn net.Conn, size int) *bufio.Reader {
+	if r, ok := readerPool.Get().(*bufio.Reader); ok && r.Size() == size {
+		r.Reset(conn)
+		return r
+	}
+	return bufio.NewReaderSize(conn, size)
+}
+
+// Returns r to readerPool, dropping its connection so the pool doesn't keep that alive.
+func putReader(r *bufio.Reader) {
+	r.Reset(nil)
+	readerPool.Put(r)
+}
+
+// Records that the client has just been active.
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// Gets how long it has been since the client was last active.
+func (c *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+// Records that a response to the client was dropped, returning how many have been so far.
+func (c *Client) drop() uint64 {
+	return atomic.AddUint64(&c.dropped, 1)
+}
+
+// Gets how many responses to the client have been dropped because it wasn't keeping up.
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Gets how many bytes of responses to the client have been dropped for going over its output rate.
+func (c *Client) ShapedBytes() uint64 {
+	return atomic.LoadUint64(&c.shapedBytes)
+}
+
+// Gets how many requests the client has sent, and responses it has been sent.
+func (c *Client) Counts() (requests uint64, responses uint64) {
+	return atomic.LoadUint64(&c.requests), atomic.LoadUint64(&c.responses)
+}
+
+// Records that the hub has unregistered or refused the client, so its connection is on the way out.
+func (c *Client) markRemoved() {
+	atomic.StoreInt32(&c.removed, 1)
+}
+
+// Checks whether the hub has unregistered the client.
+func (c *Client) isRemoved() bool {
+	return atomic.LoadInt32(&c.removed) == 1
+}
+
+// Checks whether res is one to deduplicate, and the same as the last one with its word the
+// client was sent. Only used by the hub.
+func (c *Client) repeats(res response) bool {
+	last, ok := c.lastSent[res.Word()]
+	return res.dedup && ok && bytes.Equal(last, res.packed)
+}
+
+// Remembers that res has been queued for the client, if it's one to deduplicate, or that each
+// response in it has, if it's a burst. Only used by the hub.
+func (c *Client) queued(res response) {
+	for _, part := range res.burst {
+		c.queued(part)
+	}
+	if !res.dedup {
+		return
+	}
+	if c.lastSent == nil {
+		c.lastSent = make(map[baps3.MessageWord][]byte)
+	}
+	c.lastSent[res.Word()] = res.packed
+}
+
+// Gets how long ago the client connected, to the second.
+func (c *Client) age() time.Duration {
+	return time.Since(c.connected) / time.Second * time.Second
+}
+
+// Gets the client's address. Behind a proxy speaking the PROXY protocol, that's the real client's
+// address, from the header, rather than the proxy's (see proxiedConn), as with bans and limits.
+// Everything about a client, logs included, should go by this rather than its conn's.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Identifies the client as "#<id> <remoteaddr>", for logging.
+func (c *Client) String() string {
+	return fmt.Sprintf("#%d %s", c.id, c.RemoteAddr())
+}
+
+// Passes a request to the hub down reqCh. Returns false if ctx is cancelled first.
+func (c *Client) request(ctx context.Context, reqCh chan<- clientAndMessage, req clientAndMessage) bool {
+	select {
+	case reqCh <- req:
+		atomic.AddUint64(&c.requests, 1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Handles a request from the client that couldn't be understood, because of err.
+// The hub is asked to tell the client what went wrong. Returns true if the client has now sent
+// more than maxBadRequests bad requests, and so should be disconnected, or if ctx is cancelled.
+func (c *Client) badRequest(ctx context.Context, reqCh chan<- clientAndMessage, err error) bool {
+	c.logger.Warn("Bad request from", c, ":", err.Error())
+	if !c.request(ctx, reqCh, clientAndMessage{c: c, err: err}) {
+		return true
+	}
+
+	c.badRequests++
+	if c.maxBadRequests > 0 && c.badRequests > c.maxBadRequests {
+		c.logger.Warn("Disconnecting", c, "after", c.badRequests, "bad requests")
+		return true
+	}
+	return false
 }
 
 // Reads data from a client connection. All received request messages get sent down reqCh.
+// Requests that can't be understood, including lines longer than maxLineLength and requests with
+// more than maxArgs arguments, are sent as errors, for the hub to reply to.
 // Bails if reading bytes causes an error, which gets the connection unregistered and disconnected.
-func (c *Client) Read(reqCh chan<- clientAndMessage, rmCh chan<- *Client) {
-	reader := bufio.NewReader(c.conn)
+// This includes the read timing out, if the client has a readTimeout, and sending too many bad
+// requests, if it has a maxBadRequests. Once ctx is cancelled, Read stops without waiting for
+// the hub; the hub closes the connection, so Read doesn't stay blocked on it.
+func (c *Client) Read(ctx context.Context, reqCh chan<- clientAndMessage, rmCh chan<- *Client) {
+	defer func() {
+		select {
+		case rmCh <- c:
+		case <-ctx.Done():
+		}
+	}()
+
+	// Lines are read straight out of the reader's buffer, without copying. This is safe as nothing
+	// keeps hold of them: Tokenise copies what it needs into strings before the next read, and the
+	// buffer isn't handed back to the pool until Read is done with it.
+	reader := getReader(c.conn, c.maxLineLength)
+	defer putReader(reader)
 	for {
+		// Each successful read pushes the deadline back, so only idle clients time out
+		if c.readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+
 		// Get new request
-		line, err := reader.ReadBytes('\n')
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Throw away the rest of the line, so none of it gets taken as a request
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err == nil {
+				if c.badRequest(ctx, reqCh, fmt.Errorf("Line longer than %d bytes", c.maxLineLength)) {
+					return
+				}
+				continue
+			}
+		}
 		if err != nil {
-			log.Println("Error reading from", c.conn.RemoteAddr(), ":", err.Error())
-			rmCh <- c
+			if c.isRemoved() {
+				// Expected, as the connection was closed on purpose
+				c.logger.Debug("Stopped reading from", c, ":", err.Error())
+			} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				c.logger.Info("Read from", c, "timed out after", c.readTimeout)
+			} else {
+				c.logger.Warn("Error reading from", c, ":", err.Error())
+			}
 			return
 		}
+		// baps3 is text, and the tokeniser would refuse the line anyway, so there's no passing
+		// anything else through; this just says why, and keeps it away from the tokeniser.
+		if !utf8.Valid(line) {
+			if c.badRequest(ctx, reqCh, fmt.Errorf("Invalid UTF-8")) {
+				return
+			}
+			continue
+		}
 		lines, _, err := c.tok.Tokenise(line)
 		if err != nil {
-			log.Println(err)
-			continue // TODO: Do something?
+			if c.badRequest(ctx, reqCh, err) {
+				return
+			}
+			continue
 		}
+		c.touch()
 		for _, line := range lines {
+			tag, line, ok := splitTag(line)
+			if !ok {
+				if c.badRequest(ctx, reqCh, fmt.Errorf("Bad tag")) {
+					return
+				}
+				continue
+			}
+			if c.maxArgs > 0 && len(line)-1 > c.maxArgs {
+				if c.badRequest(ctx, reqCh, fmt.Errorf("More than %d arguments", c.maxArgs)) {
+					return
+				}
+				continue
+			}
+			if isLocalRequest(line) {
+				if !c.request(ctx, reqCh, clientAndMessage{c: c, local: line, tag: tag}) {
+					return
+				}
+				continue
+			}
 			msg, err := baps3.LineToMessage(line)
 			if err != nil {
-				log.Println(err)
-				continue // TODO: Do something?
+				if c.badRequest(ctx, reqCh, err) {
+					return
+				}
+				continue
+			}
+			if !c.request(ctx, reqCh, clientAndMessage{c: c, msg: *msg, tag: tag}) {
+				return
 			}
-			reqCh <- clientAndMessage{c, *msg}
 		}
 	}
 }
 
+// Write holds back sending a batch of responses for at most this long, so one slow stream of
+// responses can't hold all of them up indefinitely.
+const MAX_WRITE_BATCH_TIME = 10 * time.Millisecond
+
+// Most bytes, and responses, a batch of responses can be before it's written anyway. The latter
+// keeps each write within the number of buffers a vectored write can take.
+const (
+	MAX_WRITE_BATCH_BYTES     = 64 * 1024
+	MAX_WRITE_BATCH_RESPONSES = 1024
+)
+
+// A batch of responses for Write to send in as few writes to conn as it can. Connections that can
+// do vectored writes, TCP and Unix sockets, are sent the whole batch with one, straight from the
+// responses' packed bytes. The rest, like TLS connections, have them copied into a buffer, as each
+// write to those costs more than the copying.
+type responseBatch struct {
+	conn net.Conn
+	// What's in the batch, when the connection can do vectored writes, and how many bytes it is.
+	// out is what's left of it to write, while it's being written.
+	bufs net.Buffers
+	out  net.Buffers
+	size int
+	// Where the batch is buffered, when it can't.
+	w *bufio.Writer
+}
+
+func initResponseBatch(conn net.Conn) *responseBatch {
+	b := &responseBatch{conn: conn}
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		b.w = bufio.NewWriter(conn)
+	}
+	return b
+}
+
+// Adds packed to the batch. This only actually writes to the connection if the batch is full.
+func (b *responseBatch) add(packed []byte) error {
+	if b.w != nil {
+		_, err := b.w.Write(packed)
+		return err
+	}
+	b.bufs = append(b.bufs, packed)
+	b.size += len(packed)
+	if b.size >= MAX_WRITE_BATCH_BYTES || len(b.bufs) >= MAX_WRITE_BATCH_RESPONSES {
+		return b.flush()
+	}
+	return nil
+}
+
+// Writes out everything in the batch. A batch of one is just written, as is.
+func (b *responseBatch) flush() (err error) {
+	if b.w != nil {
+		return b.w.Flush()
+	}
+	switch len(b.bufs) {
+	case 0:
+	case 1:
+		_, err = b.conn.Write(b.bufs[0])
+	default:
+		// WriteTo uses up the slice it's called on, so it's given a copy, leaving bufs to reuse
+		b.out = b.bufs
+		_, err = b.out.WriteTo(b.conn)
+	}
+	// Don't keep responses alive until they're overwritten
+	for i := range b.bufs {
+		b.bufs[i] = nil
+	}
+	b.bufs, b.size = b.bufs[:0], 0
+	return
+}
+
 // Writes new responses to the client connection.
-// New responses are got from resCh. Errors in writing the data
-// will cause the connection to be disconnected, via rmCh.
-func (c *Client) Write(resCh <-chan baps3.Message, rmCh chan<- *Client) {
+// New responses are got from resCh, already packed, or from the client's lowCh when resCh has
+// nothing waiting, so low priority responses can't hold up anything more important. Responses
+// that are already waiting are batched into as few writes as can be (see responseBatch), which
+// are sent as soon as both are empty. Bursts (see hub.packBurst) are sent one response at a time.
+// lowCh is never closed, as only the hub sends on it, and only to registered clients.
+// If the client has a shaper, responses are held back, or dropped if dropShaped, to keep to its
+// output rate. Errors in writing the data, including timing out, will cause the connection to be
+// disconnected, via rmCh.
+// Write returns once resCh is closed and it has sent what's left. If ctx is cancelled first, it
+// carries on sending until resCh is closed, so the hub can say goodbye, but for no longer than
+// SHUTDOWN_FLUSH_TIMEOUT.
+func (c *Client) Write(ctx context.Context, resCh <-chan response, rmCh chan<- *Client) {
+	batch := initResponseBatch(c.conn)
+	// How many responses are in the batch, and when the first of them went in
+	unflushed := 0
+	var batchStarted time.Time
+
+	flush := func() error {
+		if unflushed == 0 {
+			return nil
+		}
+		c.setWriteDeadline()
+		if err := batch.flush(); err != nil {
+			return err
+		}
+		atomic.AddUint64(&c.responses, uint64(unflushed))
+		unflushed = 0
+		c.touch()
+		return nil
+	}
+	fail := func(err error) {
+		c.writeFailed(err)
+		select {
+		case rmCh <- c:
+		case <-ctx.Done():
+		}
+	}
+
+	// Once ctx is done, done is nil and giveUp is when to stop waiting for resCh to be closed
+	done := ctx.Done()
+	var giveUp <-chan time.Time
+
 	for {
-		msg, ok := <-resCh
-		// Channel's been closed
-		if !ok {
-			return
+		if unflushed > 0 && time.Since(batchStarted) >= MAX_WRITE_BATCH_TIME {
+			if err := flush(); err != nil {
+				fail(err)
+				return
+			}
 		}
-		data, err := msg.Pack()
-		if err != nil {
-			log.Println(err.Error())
+
+		var res response
+		var ok bool
+		select {
+		case res, ok = <-resCh:
+		case <-done:
+			done, giveUp = nil, time.After(SHUTDOWN_FLUSH_TIMEOUT)
 			continue
+		default:
+			select {
+			case res, ok = <-c.lowCh:
+			default:
+				// Nothing else is waiting, so send the batch before waiting for more
+				if err := flush(); err != nil {
+					fail(err)
+					return
+				}
+				select {
+				case res, ok = <-resCh:
+				case res, ok = <-c.lowCh:
+				case <-done:
+					done, giveUp = nil, time.After(SHUTDOWN_FLUSH_TIMEOUT)
+					continue
+				case <-giveUp:
+					return
+				}
+			}
 		}
-		_, err = c.conn.Write(data)
-		if err != nil {
-			log.Println("Error writing from", c.conn.RemoteAddr(), ":", err.Error())
-			rmCh <- c
+		// Channel's been closed, so the client's already been removed
+		if !ok {
+			if err := flush(); err != nil {
+				c.writeFailed(err)
+			}
 			return
 		}
+
+		// A burst is sent just as if each of its responses had come separately
+		parts := res.burst
+		if parts == nil {
+			parts = []response{res}
+		}
+		for _, part := range parts {
+			if n := float64(len(part.packed)); c.shaper != nil && c.dropShaped {
+				if !c.shaper.allowN(n) {
+					atomic.AddUint64(&c.shapedBytes, uint64(len(part.packed)))
+					c.logger.Debug("Dropped", part.String(), "to", c, "over its output rate")
+					continue
+				}
+			} else if c.shaper != nil {
+				// The wait may come up a little short, so it isn't sent until it's paid for
+				for !c.shaper.allowN(n) {
+					// Don't hold up what's already batched while waiting
+					if err := flush(); err != nil {
+						fail(err)
+						return
+					}
+					select {
+					case <-time.After(c.shaper.waitN(n)):
+					case <-done:
+						done, giveUp = nil, time.After(SHUTDOWN_FLUSH_TIMEOUT)
+					case <-giveUp:
+						return
+					}
+				}
+			}
+
+			if unflushed == 0 {
+				batchStarted = time.Now()
+			}
+			// This only actually writes to the connection if the batch is full
+			c.setWriteDeadline()
+			if err := batch.add(part.packed); err != nil {
+				fail(err)
+				return
+			}
+			unflushed++
+		}
+	}
+}
+
+// Gives the next write to the connection writeTimeout to finish, if the client has one.
+func (c *Client) setWriteDeadline() {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// Logs why writing to the client failed.
+func (c *Client) writeFailed(err error) {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		c.logger.Info("Write to", c, "timed out after", c.writeTimeout)
+	} else {
+		c.logger.Warn("Error writing from", c, ":", err.Error())
 	}
 }
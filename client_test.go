@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	// Nothing ever reads from the other end of the pipe, so writes block
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:           nextClientID(),
+		conn:         conn,
+		logger:       newStdLogger(levelInfo),
+		resCh:        make(chan response),
+		tok:          baps3.NewTokeniser(),
+		writeTimeout: 50 * time.Millisecond,
+	}
+	rmCh := make(chan *Client)
+	go c.Write(context.Background(), c.resCh, rmCh)
+
+	res, _ := packResponse(*baps3.NewMessage(baps3.RsState).AddArg("Ready"))
+	c.resCh <- res
+
+	select {
+	case removed := <-rmCh:
+		if removed != c {
+			t.Errorf("TestWriteTimeout: %v removed, want %v", removed, c)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestWriteTimeout: client not removed after write timeout")
+	}
+}
+
+func TestReadBadRequest(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:             nextClientID(),
+		conn:           conn,
+		logger:         newStdLogger(levelInfo),
+		tok:            baps3.NewTokeniser(),
+		maxBadRequests: 1,
+		maxLineLength:  1024,
+	}
+	reqCh := make(chan clientAndMessage)
+	rmCh := make(chan *Client)
+	go c.Read(context.Background(), reqCh, rmCh)
+
+	// Words have to be valid UTF-8, so this can't be tokenised
+	for i := 0; i < 2; i++ {
+		go other.Write([]byte("enqueue \xff\xfe\n"))
+		select {
+		case req := <-reqCh:
+			if req.err == nil || req.err.Error() != "Invalid UTF-8" {
+				t.Errorf("TestReadBadRequest: request %d has err %v, want invalid UTF-8", i, req.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestReadBadRequest: request %d not passed on", i)
+		}
+	}
+
+	// That's one bad request too many
+	select {
+	case removed := <-rmCh:
+		if removed != c {
+			t.Errorf("TestReadBadRequest: %v removed, want %v", removed, c)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestReadBadRequest: client not removed after too many bad requests")
+	}
+}
+
+func TestReadLongLine(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:            nextClientID(),
+		conn:          conn,
+		logger:        newStdLogger(levelInfo),
+		tok:           baps3.NewTokeniser(),
+		maxLineLength: 1024,
+	}
+	reqCh := make(chan clientAndMessage)
+	rmCh := make(chan *Client)
+	go c.Read(context.Background(), reqCh, rmCh)
+
+	go func() {
+		other.Write(bytes.Repeat([]byte("a"), 4*1024*1024))
+		other.Write([]byte("\ndump\n"))
+	}()
+
+	// The long line should be refused, and then not stop the next one getting through
+	select {
+	case req := <-reqCh:
+		if req.err == nil {
+			t.Errorf("TestReadLongLine: long line has nil err, should be err")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestReadLongLine: long line not passed on")
+	}
+	select {
+	case req := <-reqCh:
+		if req.err != nil || req.msg.Word() != baps3.RqDump {
+			t.Errorf("TestReadLongLine: got %v, want dump", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestReadLongLine: dump not passed on")
+	}
+}
+
+func TestReadTooManyArgs(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:            nextClientID(),
+		conn:          conn,
+		logger:        newStdLogger(levelInfo),
+		tok:           baps3.NewTokeniser(),
+		maxLineLength: 64 * 1024,
+		maxArgs:       4,
+	}
+	reqCh := make(chan clientAndMessage)
+	go c.Read(context.Background(), reqCh, make(chan *Client, 1))
+
+	go other.Write([]byte("enqueue" + strings.Repeat(" x", 1000) + "\nenqueue 0 abcdef file /music/song.mp3\n"))
+	for _, wantErr := range []bool{true, false} {
+		select {
+		case req := <-reqCh:
+			if (req.err != nil) != wantErr {
+				t.Errorf("TestReadTooManyArgs: got err %v, want err %v", req.err, wantErr)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TestReadTooManyArgs: request not passed on")
+		}
+	}
+}
+
+func TestClientCounts(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:            nextClientID(),
+		conn:          conn,
+		logger:        newStdLogger(levelInfo),
+		resCh:         make(chan response, 1),
+		tok:           baps3.NewTokeniser(),
+		maxLineLength: 1024,
+	}
+	reqCh := make(chan clientAndMessage)
+	rmCh := make(chan *Client)
+	go c.Read(context.Background(), reqCh, rmCh)
+	go c.Write(context.Background(), c.resCh, rmCh)
+
+	go other.Write([]byte("dump\n"))
+	<-reqCh
+	res, _ := packResponse(*baps3.NewMessage(baps3.RsOk))
+	c.resCh <- res
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	other.Read(make([]byte, 16))
+
+	// The write is counted once it's finished, which can be just after the read
+	for i := 0; i < 100; i++ {
+		if requests, responses := c.Counts(); requests == 1 && responses == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	requests, responses := c.Counts()
+	t.Errorf("TestClientCounts: got %d requests and %d responses, want 1 and 1", requests, responses)
+}
+
+// Simulates a chatty client sending b.N requests down one connection.
+func BenchmarkRead(b *testing.B) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		id:            nextClientID(),
+		conn:          conn,
+		logger:        newStdLogger(levelError),
+		tok:           baps3.NewTokeniser(),
+		maxLineLength: 64 * 1024,
+	}
+	reqCh := make(chan clientAndMessage)
+	rmCh := make(chan *Client, 1)
+	go c.Read(context.Background(), reqCh, rmCh)
+
+	line := []byte("enqueue 0 abcdef file /music/song.mp3\n")
+	go func() {
+		for i := 0; i < b.N; i++ {
+			other.Write(line)
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-reqCh
+	}
+}
+
+// Simulates b.N short-lived clients, each sending one request before disconnecting.
+func BenchmarkReadConnections(b *testing.B) {
+	reqCh := make(chan clientAndMessage)
+	rmCh := make(chan *Client)
+	line := []byte("enqueue 0 abcdef file /music/song.mp3\n")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn, other := net.Pipe()
+		c := &Client{
+			id:            nextClientID(),
+			conn:          conn,
+			logger:        newStdLogger(levelError),
+			tok:           baps3.NewTokeniser(),
+			maxLineLength: 64 * 1024,
+			removed:       1,
+		}
+		go c.Read(context.Background(), reqCh, rmCh)
+		go func() {
+			other.Write(line)
+			other.Close()
+		}()
+		<-reqCh
+		<-rmCh
+		conn.Close()
+	}
+}
+
+// Counts the writes made to a connection, each of which would be a syscall on a real one.
+type countingConn struct {
+	net.Conn
+	writes uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddUint64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestWriteBatches(t *testing.T) {
+	const numMsgs = 10
+	conn, other := net.Pipe()
+	defer other.Close()
+	counted := &countingConn{Conn: conn}
+
+	c := &Client{
+		id:     nextClientID(),
+		conn:   counted,
+		logger: newStdLogger(levelInfo),
+		resCh:  make(chan response, numMsgs),
+	}
+	// Everything is waiting before Write starts, so should go out in one write
+	for i := 0; i < numMsgs; i++ {
+		res, _ := packResponse(*baps3.NewMessage(baps3.RsOk))
+		c.resCh <- res
+	}
+	close(c.resCh)
+	done := make(chan struct{})
+	go func() {
+		c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+		conn.Close()
+		close(done)
+	}()
+
+	data, _ := ioutil.ReadAll(other)
+	<-done
+	if want := bytes.Repeat([]byte("OK\n"), numMsgs); !bytes.Equal(data, want) {
+		t.Errorf("TestWriteBatches: got %q, want %q", data, want)
+	}
+	if counted.writes != 1 {
+		t.Errorf("TestWriteBatches: got %d writes, want 1", counted.writes)
+	}
+	if _, responses := c.Counts(); responses != numMsgs {
+		t.Errorf("TestWriteBatches: counted %d responses, want %d", responses, numMsgs)
+	}
+}
+
+// Writes numMsgs OKs to a client shaped to rate bytes per second, in bursts of burst, returning
+// what was written and the client.
+func writeShaped(rate float64, burst int, drop bool, numMsgs int) ([]byte, *Client) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := &Client{
+		id:         nextClientID(),
+		conn:       conn,
+		logger:     newStdLogger(levelInfo),
+		resCh:      make(chan response, numMsgs),
+		shaper:     newTokenBucket(rate, burst),
+		dropShaped: drop,
+	}
+	for i := 0; i < numMsgs; i++ {
+		res, _ := packResponse(*baps3.NewMessage(baps3.RsOk))
+		c.resCh <- res
+	}
+	close(c.resCh)
+	go func() {
+		c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+		conn.Close()
+	}()
+	data, _ := ioutil.ReadAll(other)
+	return data, c
+}
+
+func TestWriteShapingDrop(t *testing.T) {
+	// Room for three 3-byte OKs, and not enough time to refill for a fourth
+	data, c := writeShaped(0.1, 10, true, 5)
+	if want := bytes.Repeat([]byte("OK\n"), 3); !bytes.Equal(data, want) {
+		t.Errorf("TestWriteShapingDrop: got %q, want %q", data, want)
+	}
+	if shaped := c.ShapedBytes(); shaped != 6 {
+		t.Errorf("TestWriteShapingDrop: %d bytes counted as dropped, want 6", shaped)
+	}
+}
+
+func TestWriteShapingDelay(t *testing.T) {
+	// One OK at a time, at one every 3ms
+	start := time.Now()
+	data, c := writeShaped(1000, 3, false, 5)
+	if want := bytes.Repeat([]byte("OK\n"), 5); !bytes.Equal(data, want) {
+		t.Errorf("TestWriteShapingDelay: got %q, want %q", data, want)
+	}
+	if elapsed := time.Since(start); elapsed < 12*time.Millisecond {
+		t.Errorf("TestWriteShapingDelay: wrote everything in %s, want at least 12ms", elapsed)
+	}
+	if shaped := c.ShapedBytes(); shaped != 0 {
+		t.Errorf("TestWriteShapingDelay: %d bytes dropped, want none", shaped)
+	}
+}
+
+// However long the wait, every response is paid for, so the output rate is kept to over time.
+func TestWriteShapingDelayRate(t *testing.T) {
+	const rate, numMsgs = 1000, 30
+	start := time.Now()
+	// Each OK is worth more than the burst, so leaves the bucket in debt
+	data, _ := writeShaped(rate, 2, false, numMsgs)
+	elapsed := time.Since(start)
+	if len(data) != 3*numMsgs {
+		t.Fatalf("TestWriteShapingDelayRate: wrote %d bytes, want %d", len(data), 3*numMsgs)
+	}
+	// The first OK goes straight away, from the full bucket
+	if got := float64(len(data)-3) / elapsed.Seconds(); got > rate {
+		t.Errorf("TestWriteShapingDelayRate: wrote %.0f bytes per second, want at most %d", got, rate)
+	}
+}
+
+// Responses on resCh jump ahead of the low priority TIMEs already waiting on lowCh.
+func TestWritePriority(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := &Client{
+		id:     nextClientID(),
+		conn:   conn,
+		logger: newStdLogger(levelInfo),
+		resCh:  make(chan response, 1),
+		lowCh:  make(chan response, 3),
+	}
+	for i := 0; i < 3; i++ {
+		res, _ := packResponse(*baps3.NewMessage(baps3.RsTime).AddArg(strconv.Itoa(i)))
+		c.lowCh <- res
+	}
+	res, _ := packResponse(*baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+	c.resCh <- res
+	go c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+
+	r := bufio.NewReader(other)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []string{"STATE Playing\n", "TIME 0\n", "TIME 1\n", "TIME 2\n"} {
+		if line, err := r.ReadString('\n'); line != want {
+			t.Fatalf("TestWritePriority: got %q (%v), want %q", line, err, want)
+		}
+	}
+}
+
+// Makes a connected pair of TCP connections over loopback, which can do vectored writes.
+func tcpPipe(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("tcpPipe: returned err on listen (%s)", err.Error())
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatalf("tcpPipe: returned err on dial (%s)", err.Error())
+	}
+	other, err := l.Accept()
+	if err != nil {
+		tb.Fatalf("tcpPipe: returned err on accept (%s)", err.Error())
+	}
+	return conn, other
+}
+
+// Batches too big for one write are written as they fill up, with nothing lost or reordered.
+func TestResponseBatchVectored(t *testing.T) {
+	conn, other := tcpPipe(t)
+	defer other.Close()
+	b := initResponseBatch(conn)
+	if b.w != nil {
+		t.Fatalf("TestResponseBatchVectored: TCP connection batched with a buffer")
+	}
+
+	var want bytes.Buffer
+	var batched [][]byte
+	for i := 0; i < 2*MAX_WRITE_BATCH_RESPONSES+1; i++ {
+		packed := []byte("COUNT " + strconv.Itoa(i) + "\n")
+		want.Write(packed)
+		batched = append(batched, packed)
+	}
+	go func() {
+		defer conn.Close()
+		for _, packed := range batched {
+			if err := b.add(packed); err != nil {
+				t.Errorf("TestResponseBatchVectored: returned err on add (%s)", err.Error())
+				return
+			}
+		}
+		if err := b.flush(); err != nil {
+			t.Errorf("TestResponseBatchVectored: returned err on flush (%s)", err.Error())
+		}
+	}()
+
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(other)
+	if err != nil {
+		t.Fatalf("TestResponseBatchVectored: returned err on read (%s)", err.Error())
+	}
+	if !bytes.Equal(data, want.Bytes()) {
+		t.Errorf("TestResponseBatchVectored: got %d bytes, not the %d batched", len(data), want.Len())
+	}
+}
+
+// Gets how many write syscalls, vectored or not, the process has made, where Linux says.
+func writeSyscalls() (n uint64, ok bool) {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw: ") {
+			n, err = strconv.ParseUint(strings.TrimPrefix(line, "syscw: "), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// Sends b.N of the burst of responses a client gets on connecting, with a long playlist, over TCP,
+// with vectored writes and, hiding that the connection can do them, buffered ones. Where it can,
+// it reports how many write syscalls each burst takes.
+func BenchmarkWriteConnectBurst(b *testing.B) {
+	h := makeTestHub()
+	for i := 0; i < 200; i++ {
+		h.pl.items = append(h.pl.items, &PlaylistItem{Data: "/music/track" + strconv.Itoa(i) + ".mp3", Hash: strconv.Itoa(i), IsFile: true})
+	}
+	var burst []response
+	for _, msg := range append([]*baps3.Message{h.makeRsOhai(), h.makeRsFeatures(&Client{})}, h.makeDumpResponses()...) {
+		res, _ := packResponse(*msg)
+		burst = append(burst, res)
+	}
+	size := 0
+	for _, res := range burst {
+		size += len(res.packed)
+	}
+
+	run := func(b *testing.B, wrap func(net.Conn) net.Conn) {
+		conn, other := tcpPipe(b)
+		defer other.Close()
+		c := &Client{
+			id:     nextClientID(),
+			conn:   wrap(conn),
+			logger: newStdLogger(levelError),
+			resCh:  make(chan response, len(burst)),
+		}
+		go c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+		defer close(c.resCh)
+
+		buf := make([]byte, size)
+		b.SetBytes(int64(size))
+		before, counted := writeSyscalls()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, res := range burst {
+				c.resCh <- res
+			}
+			io.ReadFull(other, buf)
+		}
+		b.StopTimer()
+		if after, _ := writeSyscalls(); counted {
+			b.ReportMetric(float64(after-before)/float64(b.N), "syscalls/op")
+		}
+	}
+	b.Run("vectored", func(b *testing.B) {
+		run(b, func(conn net.Conn) net.Conn { return conn })
+	})
+	b.Run("buffered", func(b *testing.B) {
+		run(b, func(conn net.Conn) net.Conn { return struct{ net.Conn }{conn} })
+	})
+}
+
+// Broadcasts b.N bursts of responses to one client, reporting how many writes each burst takes.
+func BenchmarkWriteBurst(b *testing.B) {
+	const burst = 50
+	conn, other := net.Pipe()
+	defer other.Close()
+	counted := &countingConn{Conn: conn}
+	defer counted.Close()
+
+	c := &Client{
+		id:     nextClientID(),
+		conn:   counted,
+		logger: newStdLogger(levelError),
+		resCh:  make(chan response, burst),
+	}
+	go c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+
+	res, _ := packResponse(*baps3.NewMessage(baps3.RsTime).AddArg("1000"))
+	buf := make([]byte, burst*len(res.packed))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burst; j++ {
+			c.resCh <- res
+		}
+		io.ReadFull(other, buf)
+	}
+	b.ReportMetric(float64(atomic.LoadUint64(&counted.writes))/float64(b.N), "writes/op")
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Local request handler
+//
+// Local requests are listd's own commands, which aren't baps3 words and so can't be turned into
+// baps3.Messages. They are picked out by Client.Read before any conversion, are never forwarded to
+// the downstream service, and their responses only go to the client that sent them.
+//
+
+var LOCAL_REQ_FUNC_MAP = map[string]func(*hub, *Client, []string) []*baps3.Message{
+	"iam":          (*hub).processReqIam,
+	"list-clients": (*hub).processReqListClients,
+	"uptime":       (*hub).processReqUptime,
+	"version":      (*hub).processReqVersion,
+	"quit":         (*hub).processReqQuit,
+	"time-updates": (*hub).processReqTimeUpdates,
+	"sequence":     (*hub).processReqSequence,
+	"kick":         (*hub).processReqKick,
+	"announce":     (*hub).processReqAnnounce,
+	"drain":        (*hub).processReqDrain,
+	"set-feature":  (*hub).processReqSetFeature,
+
+	"connector-status": (*hub).processReqConnectorStatus,
+}
+
+// Local requests only admins may send.
+var ADMIN_LOCAL_REQS = map[string]bool{
+	"list-clients": true,
+	"kick":         true,
+	"announce":     true,
+	"drain":        true,
+	"set-feature":  true,
+}
+
+// Checks whether a request's command word is one of listd's local requests.
+func isLocalRequest(line []string) bool {
+	if len(line) == 0 {
+		return false
+	}
+	_, ok := LOCAL_REQ_FUNC_MAP[line[0]]
+	return ok
+}
+
+// Checks whether c may send requests other than iam.
+// If no users are configured, authentication is off and every client may.
+func (h *hub) isAuthenticated(c *Client) bool {
+	return len(h.config.Users) == 0 || c.user != ""
+}
+
+// Checks whether c authenticated as one of the configured admins.
+// If authentication is off, nobody is an admin.
+func (h *hub) isAdmin(c *Client) bool {
+	return c.user != "" && containsString(h.config.Admins, c.user)
+}
+
+func makeNotAuthenticatedMsg() *baps3.Message {
+	return baps3.NewMessage(baps3.RsFail).AddArg("Not authenticated")
+}
+
+// Sorts clients by ID, so oldest first.
+type clientsByID []*Client
+
+func (cs clientsByID) Len() int           { return len(cs) }
+func (cs clientsByID) Less(i, j int) bool { return cs[i].id < cs[j].id }
+func (cs clientsByID) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+
+// Lists every connected client, one 'OK list-clients <id> <address> <age> <requests> <responses>'
+// per client, counting the requests it has sent and responses it has been sent.
+func (h *hub) processReqListClients(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 0 {
+		return makeBadCommandMsgs()
+	}
+
+	clients := make(clientsByID, 0, len(h.clients))
+	for cl, _ := range h.clients {
+		clients = append(clients, cl)
+	}
+	sort.Sort(clients)
+
+	for _, cl := range clients {
+		requests, responses := cl.Counts()
+		resps = append(resps, baps3.NewMessage(baps3.RsOk).AddArg("list-clients").AddArg(strconv.FormatUint(cl.id, 10)).AddArg(cl.RemoteAddr().String()).AddArg(cl.age().String()).AddArg(strconv.FormatUint(requests, 10)).AddArg(strconv.FormatUint(responses, 10)))
+	}
+	return
+}
+
+// Disconnects another client, with 'kick <id> [reason]', as listed by list-clients.
+// The kicked client is told it was kicked, and why if a reason is given.
+func (h *hub) processReqKick(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 1 && len(args) != 2 {
+		return makeBadCommandMsgs()
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad client ID"))
+	}
+
+	var target *Client
+	for cl, _ := range h.clients {
+		if cl.id == id {
+			target = cl
+			break
+		}
+	}
+	if target == nil {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No such client"))
+	}
+
+	// As with quit, the message gets there before the connection is closed
+	msg := baps3.NewMessage(baps3.RsFail).AddArg("Kicked")
+	var reason string
+	if len(args) == 2 {
+		reason = args[1]
+		msg.AddArg(reason)
+	}
+	h.send(target, *msg)
+	if _, ok := h.clients[target]; ok {
+		h.publish(EventKick, target, reason)
+		h.removeClient(target)
+	}
+	h.logger.Info("Client", target, "kicked by", c.user, "from", c, ":", msg.String())
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("kick").AddArg(args[0]))
+}
+
+// Sends every connected client, the sender included, 'OK announcement <text>', with
+// 'announce <text>'. The words of an unquoted text are joined with spaces. The announcement is
+// sent as any response is, so slow clients may miss it. The sender is told how many clients it
+// was sent to, as 'OK announce <count>'.
+func (h *hub) processReqAnnounce(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) == 0 {
+		return makeBadCommandMsgs()
+	}
+	text := strings.Join(args, " ")
+	packed, ok := h.pack(*baps3.NewMessage(baps3.RsOk).AddArg("announcement").AddArg(text))
+	if !ok {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("Bad announcement"))
+	}
+	sent := 0
+	for cl, _ := range h.clients {
+		if h.sendPacked(cl, packed) {
+			sent++
+		}
+	}
+	h.logger.Info("Announcement from", c.user, "at", c, "sent to", sent, "clients:", text)
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("announce").AddArg(strconv.Itoa(sent)))
+}
+
+// Starts or stops draining (see hub.setDraining), with 'drain on|off'.
+func (h *hub) processReqDrain(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return makeBadCommandMsgs()
+	}
+	h.logger.Info("Drain", args[0], "from", c.user, "at", c)
+	h.setDraining(args[0] == "on")
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("drain").AddArg(args[0]))
+}
+
+// What set-feature can turn off, and back on, while listd runs. All are on to start with.
+// "heartbeat" is the heartbeats (see HeartbeatInterval), "time" the TIME responses, and
+// "time-throttle" holding them back (see TimeInterval). "state-replay" is sending new clients the
+// cached responses (see CachedResponses).
+var RUNTIME_FEATURES = []string{"heartbeat", "time", "time-throttle", "state-replay"}
+
+// Turns one of RUNTIME_FEATURES on or off, with 'set-feature <name> on|off', straight away.
+// It stays that way until set again, or listd restarts, even if the config is reloaded.
+func (h *hub) processReqSetFeature(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return makeBadCommandMsgs()
+	}
+	name := args[0]
+	if !containsString(RUNTIME_FEATURES, name) {
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("No such feature"))
+	}
+	h.featuresOff[name] = args[1] == "off"
+	h.logger.Info("Feature", name, "turned", args[1], "by", c.user, "at", c)
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("set-feature").AddArg(name).AddArg(args[1]))
+}
+
+// Checks whether one of RUNTIME_FEATURES is on.
+func (h *hub) featureOn(name string) bool {
+	return !h.featuresOff[name]
+}
+
+// Authenticates the client as a configured user, with 'iam <user> <token>'.
+func (h *hub) processReqIam(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 2 {
+		return makeBadCommandMsgs()
+	}
+	user, token := args[0], args[1]
+
+	want, ok := h.config.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		h.logger.Warn("Failed authentication from", c, "as", user)
+		c.failedAuths++
+		if max := h.config.MaxFailedAuths; max > 0 && c.failedAuths >= max {
+			h.lockOut(c)
+			return
+		}
+		return append(resps, baps3.NewMessage(baps3.RsFail).AddArg("Bad credentials"))
+	}
+
+	c.failedAuths = 0
+	c.user = user
+	h.logger.Info("Authenticated", c, "as", user)
+	// What it can do may have changed, so it's told again
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("iam").AddArg(user), h.makeRsFeatures(c))
+}
+
+// Disconnects a client that has failed to authenticate too many times, after telling it why.
+// Its IP address, if it has one, is then refused for AuthLockout.
+func (h *hub) lockOut(c *Client) {
+	// As with quit, the message gets there before the connection is closed
+	h.send(c, *baps3.NewMessage(baps3.RsFail).AddArg("Too many failed authentications"))
+	if _, ok := h.clients[c]; ok {
+		h.removeClient(c)
+	}
+
+	lockout := h.config.AuthLockout.Duration
+	if key := clientAddrKey(c); key != "" && lockout > 0 {
+		h.lockouts[key] = time.Now().Add(lockout)
+		h.logger.Warn("Disconnected", c, "after", c.failedAuths, "failed authentications, and locked out", key, "for", lockout)
+	} else {
+		h.logger.Warn("Disconnected", c, "after", c.failedAuths, "failed authentications")
+	}
+}
+
+// Forgets the lockouts that have run out, so addresses that never come back don't stay in
+// lockouts for good, however many fail to authenticate.
+func (h *hub) sweepLockouts() {
+	now := time.Now()
+	for key, until := range h.lockouts {
+		if !now.Before(until) {
+			delete(h.lockouts, key)
+		}
+	}
+}
+
+// Says when listd started and how long ago that was, as 'OK uptime <start> <duration>'.
+func (h *hub) processReqUptime(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 0 {
+		return makeBadCommandMsgs()
+	}
+	uptime := time.Since(h.started) / time.Second * time.Second
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("uptime").AddArg(h.started.Format(time.RFC3339)).AddArg(uptime.String()))
+}
+
+// Says which build of listd this is, as 'OK version <name> <version> [<commit> [<build date>]]',
+// with the name and version from the OHAI, and the rest whichever were set at build time.
+func (h *hub) processReqVersion(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 0 {
+		return makeBadCommandMsgs()
+	}
+	res := baps3.NewMessage(baps3.RsOk).AddArg("version").AddArg(h.config.ServerName).AddArg(h.config.ServerVersion)
+	if LD_COMMIT != "" {
+		res.AddArg(LD_COMMIT)
+		if LD_BUILD_DATE != "" {
+			res.AddArg(LD_BUILD_DATE)
+		}
+	}
+	return append(resps, res)
+}
+
+// Disconnects the client, after saying 'OK quit'. This is listd's quit, not the downstream service's.
+func (h *hub) processReqQuit(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 0 {
+		return makeBadCommandMsgs()
+	}
+	// Write sends everything already in resCh before it notices resCh is closed,
+	// so the goodbye gets there before the connection is closed.
+	h.send(c, *baps3.NewMessage(baps3.RsOk).AddArg("quit"))
+	if _, ok := h.clients[c]; ok {
+		h.removeClient(c)
+		h.logger.Info("Client", c, "quit")
+	}
+	return
+}
+
+// Lists every connector, one 'OK connector-status <name> <status>' per connector, playout first,
+// where status is healthy, unhealthy or disconnected.
+func (h *hub) processReqConnectorStatus(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 0 {
+		return makeBadCommandMsgs()
+	}
+	for _, conn := range h.connectors {
+		resps = append(resps, baps3.NewMessage(baps3.RsOk).AddArg("connector-status").AddArg(conn.name).AddArg(conn.status()))
+	}
+	return
+}
+
+// Turns the TIME responses the client is sent on or off, with 'time-updates on|off'.
+// Clients get them until they turn them off.
+func (h *hub) processReqTimeUpdates(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 1 {
+		return makeBadCommandMsgs()
+	}
+	switch args[0] {
+	case "on":
+		c.wantsTime = true
+	case "off":
+		c.wantsTime = false
+	default:
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("time-updates").AddArg(args[0]))
+}
+
+// Turns sequence numbers on the broadcasts the client is sent on or off, with 'sequence on|off'
+// (see withSeq). Clients don't get them until they turn them on.
+func (h *hub) processReqSequence(c *Client, args []string) (resps []*baps3.Message) {
+	if len(args) != 1 {
+		return makeBadCommandMsgs()
+	}
+	switch args[0] {
+	case "on":
+		c.wantsSeq = true
+	case "off":
+		c.wantsSeq = false
+	default:
+		return append(resps, baps3.NewMessage(baps3.RsWhat).AddArg("Bad argument"))
+	}
+	return append(resps, baps3.NewMessage(baps3.RsOk).AddArg("sequence").AddArg(args[0]))
+}
+
+// Handles a local request from a client, given as the words of its line.
+func (h *hub) processLocalRequest(c *Client, line []string) {
+	h.logger.Debug("New local request from", c, ":", line)
+	word, args := line[0], line[1:]
+
+	var responses []*baps3.Message
+	if ADMIN_LOCAL_REQS[word] && !h.isAdmin(c) {
+		h.logger.Info("Refused admin request from", c, ":", line)
+		responses = []*baps3.Message{baps3.NewMessage(baps3.RsFail).AddArg("Not an admin")}
+	} else {
+		responses = LOCAL_REQ_FUNC_MAP[word](h, c, args)
+	}
+
+	for _, resp := range responses {
+		if resp.Word() == baps3.RsFail || resp.Word() == baps3.RsWhat {
+			h.sendInvalidCmd(c, *resp, line)
+		} else {
+			h.send(c, *resp)
+		}
+	}
+}
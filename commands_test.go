@@ -0,0 +1,318 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestUptime(t *testing.T) {
+	h := makeTestHub()
+	h.started = time.Now().Add(-90 * time.Second)
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.processLocalRequest(c, []string{"uptime"})
+
+	res := <-c.resCh
+	if res.Word() != baps3.RsOk {
+		t.Fatalf("TestUptime: got %q, want OK", res.String())
+	}
+	args := res.Args()
+	if len(args) != 3 || args[0] != "uptime" {
+		t.Fatalf("TestUptime: got args %q, want uptime <start> <duration>", args)
+	}
+	if started, err := time.Parse(time.RFC3339, args[1]); err != nil || started.Unix() != h.started.Unix() {
+		t.Errorf("TestUptime: start %q does not match %v", args[1], h.started)
+	}
+	if uptime, err := time.ParseDuration(args[2]); err != nil || uptime < 90*time.Second {
+		t.Errorf("TestUptime: duration %q, want at least 1m30s", args[2])
+	}
+}
+
+func TestTimeUpdates(t *testing.T) {
+	h := makeTestHub()
+	on, onOther := makeTestClient(h)
+	defer onOther.Close()
+	off, offOther := makeTestClient(h)
+	defer offOther.Close()
+
+	h.processLocalRequest(off, []string{"time-updates", "off"})
+	if res := <-off.resCh; res.String() != "OK time-updates off" {
+		t.Fatalf("TestTimeUpdates: got %q, want %q", res.String(), "OK time-updates off")
+	}
+
+	h.broadcastResponse(*baps3.NewMessage(baps3.RsTime).AddArg("1000"))
+	if len(on.lowCh) != 1 {
+		t.Errorf("TestTimeUpdates: subscribed client got %d responses, want 1", len(on.lowCh))
+	}
+	if len(off.lowCh) != 0 {
+		t.Errorf("TestTimeUpdates: unsubscribed client got %d responses, want 0", len(off.lowCh))
+	}
+}
+
+// list-clients gives how long each client has been connected, to the second.
+func TestListClientsAge(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	admin, adminOther := makeTestClient(h)
+	defer adminOther.Close()
+	admin.user = "admin"
+	admin.connected = time.Now().Add(-90*time.Second - 300*time.Millisecond)
+
+	h.processLocalRequest(admin, []string{"list-clients"})
+	res := <-admin.resCh
+	if age, _ := res.Arg(3); age != "1m30s" {
+		t.Errorf("TestListClientsAge: got age %q in %q, want %q", age, res.String(), "1m30s")
+	}
+}
+
+func TestKick(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	admin, adminOther := makeTestClient(h)
+	defer adminOther.Close()
+	admin.user = "admin"
+	target, targetOther := makeTestClient(h)
+	defer targetOther.Close()
+
+	h.processLocalRequest(admin, []string{"kick", strconv.FormatUint(target.id, 10), "spamming"})
+
+	if res := <-target.resCh; res.String() != "FAIL Kicked spamming" {
+		t.Errorf("TestKick: kicked client got %q, want %q", res.String(), "FAIL Kicked spamming")
+	}
+	if _, ok := h.clients[target]; ok {
+		t.Errorf("TestKick: kicked client still registered")
+	}
+	if res := <-admin.resCh; res.Word() != baps3.RsOk {
+		t.Errorf("TestKick: got %q, want OK", res.String())
+	}
+
+	h.processLocalRequest(admin, []string{"kick", strconv.FormatUint(target.id, 10)})
+	if res := <-admin.resCh; res.Word() != baps3.RsFail {
+		t.Errorf("TestKick: kicking twice got %q, want FAIL", res.String())
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	admin, adminOther := makeTestClient(h)
+	defer adminOther.Close()
+	admin.user = "admin"
+	listener, listenerOther := makeTestClient(h)
+	defer listenerOther.Close()
+
+	h.processLocalRequest(listener, []string{"announce", "hello"})
+	if res := <-listener.resCh; res.String() != "FAIL Not an admin announce hello" {
+		t.Errorf("TestAnnounce: non-admin got %q, want it refused", res.String())
+	}
+
+	h.processLocalRequest(admin, []string{"announce", "off", "air", "soon"})
+	want := "OK announcement off air soon"
+	for _, c := range []*Client{admin, listener} {
+		if res := <-c.resCh; res.String() != want {
+			t.Errorf("TestAnnounce: %v got %q, want %q", c, res.String(), want)
+		}
+	}
+	if res := <-admin.resCh; res.String() != "OK announce 2" {
+		t.Errorf("TestAnnounce: sender got %q, want %q", res.String(), "OK announce 2")
+	}
+}
+
+// Admins are sent new FEATURES once they've authenticated, now with Admin.
+func TestIamFeatures(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	if words := h.makeRsFeatures(c).AsSlice(); containsString(words, ADMIN_FEATURE) {
+		t.Errorf("TestIamFeatures: got %q before authenticating, want no %s", words, ADMIN_FEATURE)
+	}
+	h.processLocalRequest(c, []string{"iam", "admin", "token"})
+	if res := <-c.resCh; res.String() != "OK iam admin" {
+		t.Fatalf("TestIamFeatures: got %q, want %q", res.String(), "OK iam admin")
+	}
+	res := <-c.resCh
+	if words := res.AsSlice(); res.Word() != baps3.RsFeatures || !containsString(words, ADMIN_FEATURE) {
+		t.Errorf("TestIamFeatures: got %q after authenticating, want FEATURES with %s", res.String(), ADMIN_FEATURE)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	h := makeTestHub()
+	h.config.ServerName, h.config.ServerVersion = "test-listd", "9.9"
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.processLocalRequest(c, []string{"version"})
+	if res := <-c.resCh; res.String() != "OK version test-listd 9.9" {
+		t.Errorf("TestVersion: got %q, want %q", res.String(), "OK version test-listd 9.9")
+	}
+}
+
+func TestSetFeature(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	admin, other := makeTestClient(h)
+	defer other.Close()
+	admin.user = "admin"
+
+	h.processLocalRequest(admin, []string{"set-feature", "time", "off"})
+	if res := <-admin.resCh; res.String() != "OK set-feature time off" {
+		t.Fatalf("TestSetFeature: got %q, want %q", res.String(), "OK set-feature time off")
+	}
+	h.processResponse(h.downstream, *baps3.NewMessage(baps3.RsTime).AddArg("1000"))
+	if n := len(admin.lowCh); n != 0 {
+		t.Errorf("TestSetFeature: got %d TIMEs with time off, want 0", n)
+	}
+
+	h.processLocalRequest(admin, []string{"set-feature", "time", "on"})
+	<-admin.resCh
+	h.processResponse(h.downstream, *baps3.NewMessage(baps3.RsTime).AddArg("2000"))
+	if n := len(admin.lowCh); n != 1 {
+		t.Errorf("TestSetFeature: got %d TIMEs with time back on, want 1", n)
+	}
+
+	h.processLocalRequest(admin, []string{"set-feature", "nonsense", "off"})
+	if res := <-admin.resCh; res.String() != "FAIL No such feature set-feature nonsense off" {
+		t.Errorf("TestSetFeature: got %q, want %q", res.String(), "FAIL No such feature set-feature nonsense off")
+	}
+}
+
+func TestFailedAuthLockout(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"user": "token"}
+	h.config.MaxFailedAuths = 2
+	h.config.AuthLockout.Duration = time.Minute
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	newClient := func() *Client {
+		conn, _ := net.Pipe()
+		c := h.newClient(fakeAddrConn{conn, addr})
+		h.addClient(c)
+		return c
+	}
+
+	c := newClient()
+	h.processLocalRequest(c, []string{"iam", "user", "wrong"})
+	if _, ok := h.clients[c]; !ok {
+		t.Fatalf("TestFailedAuthLockout: disconnected after one failure, want after two")
+	}
+	h.processLocalRequest(c, []string{"iam", "user", "wrong"})
+	if _, ok := h.clients[c]; ok {
+		t.Errorf("TestFailedAuthLockout: still connected after two failures")
+	}
+
+	locked := newClient()
+	if _, ok := h.clients[locked]; ok {
+		t.Errorf("TestFailedAuthLockout: locked out address could reconnect")
+	}
+	// Its Read is running, so it can go on guessing after the refusal
+	h.handleRequest(clientAndMessage{c: locked, local: []string{"iam", "user", "token"}})
+	for res := range locked.resCh {
+		if res.Word() == baps3.RsOk {
+			t.Errorf("TestFailedAuthLockout: locked out client got %q", res.String())
+		}
+	}
+	if locked.user != "" {
+		t.Errorf("TestFailedAuthLockout: locked out client authenticated as %q", locked.user)
+	}
+	h.lockouts[addr.IP.String()] = time.Now()
+	if _, ok := h.clients[newClient()]; !ok {
+		t.Errorf("TestFailedAuthLockout: address still refused after lockout")
+	}
+}
+
+// Lockouts that have run out are swept away, even for addresses that never reconnect.
+func TestSweepLockouts(t *testing.T) {
+	h := makeTestHub()
+	h.lockouts["192.0.2.1"] = time.Now().Add(-time.Second)
+	h.lockouts["192.0.2.2"] = time.Now().Add(time.Minute)
+
+	h.sweepLockouts()
+	if _, ok := h.lockouts["192.0.2.1"]; ok {
+		t.Errorf("TestSweepLockouts: expired lockout kept")
+	}
+	if _, ok := h.lockouts["192.0.2.2"]; !ok {
+		t.Errorf("TestSweepLockouts: current lockout swept")
+	}
+
+	// Lockouts are swept even with idle clients never swept
+	cfg := defaultConfig()
+	cfg.AuthLockout.Duration = time.Minute
+	if got := sweepInterval(cfg); got != time.Minute {
+		t.Errorf("TestSweepLockouts: sweeping every %s, want every %s", got, time.Minute)
+	}
+}
+
+func TestConnectorHealth(t *testing.T) {
+	h := makeTestHub()
+	cReqCh := make(chan baps3.Message, 2)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	h.addConnector("other", nil, []baps3.MessageWord{baps3.RqSeek})
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	// Never heard from, so probed straight away, then unhealthy once the (zero) timeout is up
+	h.checkConnectors(time.Minute, 0)
+	if req := <-cReqCh; req.Word() != baps3.RqDump {
+		t.Fatalf("TestConnectorHealth: probed with %q, want dump", req.String())
+	}
+	h.checkConnectors(time.Minute, 0)
+	<-cReqCh
+
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqPlay)})
+	if res := <-c.resCh; res.Word() != baps3.RsFail {
+		t.Errorf("TestConnectorHealth: request for unhealthy connector got %q, want FAIL", res.String())
+	}
+
+	h.processLocalRequest(c, []string{"connector-status"})
+	want := []string{"OK connector-status playout unhealthy", "OK connector-status other disconnected"}
+	for _, w := range want {
+		if res := <-c.resCh; res.String() != w {
+			t.Errorf("TestConnectorHealth: got %q, want %q", res.String(), w)
+		}
+	}
+
+	h.heardFrom(h.downstream)
+	h.processLocalRequest(c, []string{"connector-status"})
+	if res := <-c.resCh; res.String() != "OK connector-status playout healthy" {
+		t.Errorf("TestConnectorHealth: got %q after hearing from playout, want healthy", res.String())
+	}
+}
+
+// The reply to a health probe isn't broadcast, but what comes after it is.
+func TestProbeReplyNotBroadcast(t *testing.T) {
+	h := makeTestHub()
+	cReqCh := make(chan baps3.Message, 1)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.checkConnectors(time.Minute, time.Minute)
+	<-cReqCh
+	for _, res := range []*baps3.Message{
+		baps3.NewMessage(baps3.RsState).AddArg("Stopped"),
+		baps3.NewMessage(baps3.RsOk).AddArg("dump"),
+	} {
+		h.heardFrom(h.downstream)
+		h.processResponse(h.downstream, *res)
+	}
+	if n := len(c.resCh); n != 0 {
+		t.Fatalf("TestProbeReplyNotBroadcast: %d responses to the probe broadcast, want none", n)
+	}
+
+	h.processResponse(h.downstream, *baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+	if res := <-c.resCh; res.String() != "STATE Playing" {
+		t.Errorf("TestProbeReplyNotBroadcast: got %q after the probe, want %q", res.String(), "STATE Playing")
+	}
+}
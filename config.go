@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// A time.Duration that is written in config files as a string, e.g. "5m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// Another downstream service, besides the playout system, that requests with the command words
+// in Commands are sent to instead. Its responses go to clients like the playout system's.
+type ConnectorConfig struct {
+	Name     string   `json:"name"`
+	Addr     string   `json:"addr"`
+	Port     string   `json:"port"`
+	Commands []string `json:"commands"`
+}
+
+// Config holds everything that can be set from a config file or the command line.
+// Timeouts of 0 are disabled; if CertFile and KeyFile are empty, TLS is not used.
+type Config struct {
+	Addr        string `json:"addr"`
+	Port        string `json:"port"`
+	PlayoutAddr string `json:"playout_addr"`
+	PlayoutPort string `json:"playout_port"`
+	// Other downstream services, each handling some commands. Not reloaded until restart.
+	Connectors []ConnectorConfig `json:"connectors"`
+	// For testing clients without a playout system: if set, listd connects to nothing, and
+	// requests it would forward are instead sent straight back as responses. In "echo" mode they
+	// only go back to the client that sent them; in "broadcast" mode they go to every client, as
+	// responses from the playout system would. Requests listd handles itself, such as enqueue,
+	// work as usual. Not reloaded until restart.
+	Standalone string `json:"standalone"`
+
+	// What listd calls itself in its OHAI, so forks and test instances can be told apart.
+	// They default to listd's own name and version.
+	ServerName    string `json:"server_name"`
+	ServerVersion string `json:"server_version"`
+
+	LogLevel string `json:"log_level"`
+
+	MaxClients int `json:"max_clients"`
+	// Most clients that can be connected at once from one IP address. 0 means no limit.
+	MaxClientsPerAddr int `json:"max_clients_per_addr"`
+	// Most connections that can be handled at once, counting those not yet registered as clients,
+	// or about to be refused. Beyond it, new connections are closed as soon as they're accepted,
+	// so a flood of them can't start goroutines without end before MaxClients is checked.
+	// 0, the default, means no limit. Only read at startup.
+	MaxConnections int `json:"max_connections"`
+
+	// How many responses can wait for each client to be ready for them. Clients whose buffer
+	// fills up are disconnected, so it should comfortably fit the most broadcasts that can come
+	// at once, at the cost of memory per client. The reply to one request, such as listing the
+	// whole playlist, only takes up one place however long it is. Defaults to 64.
+	ResponseBuffer int `json:"response_buffer"`
+	// How many new clients, requests and leaving clients can each wait for the hub to get to
+	// them. With 0, the default, every client waits until the hub takes what it has, so nothing
+	// sits queued for long; a buffer lets storms of connections or requests queue up instead of
+	// holding up every client's Read, at the cost of requests taking longer to be acted on while
+	// the hub is busy. It doesn't make the hub itself any faster. Only read at startup.
+	ChannelBuffer int `json:"channel_buffer"`
+	// How many responses a client can miss because its buffer is full before it is
+	// disconnected. Defaults to 0, so slow clients are disconnected straight away.
+	MaxDropped int `json:"max_dropped"`
+
+	ReadTimeout  duration `json:"read_timeout"`
+	WriteTimeout duration `json:"write_timeout"`
+	IdleTimeout  duration `json:"idle_timeout"`
+
+	// If not 0, TCP keepalive probes are sent to clients this often, so the OS notices dead peers
+	// even without heartbeats. If 0, connections are left with Go's own setting.
+	TCPKeepAlive duration `json:"tcp_keepalive"`
+	// "on" sends each write to clients straight away (TCP_NODELAY); "off" lets the OS hold small
+	// writes back to coalesce them (Nagle's algorithm). If empty, connections are left with Go's
+	// own setting, which is on. Responses waiting together are already batched into one write,
+	// so "on" costs few extra packets, while "off" can delay interactive responses by tens of
+	// milliseconds for little gain.
+	TCPNoDelay string `json:"tcp_nodelay"`
+	// Whether every connection starts with a PROXY protocol header giving the real client's
+	// address, as when behind a load balancer. Only turn it on behind a trusted proxy.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// Least time between TIME responses sent to clients. The downstream service sends them much
+	// more often than most clients need; those in between are dropped, but the latest one is
+	// always sent eventually. Defaults to 500ms; 0 sends every one.
+	TimeInterval duration `json:"time_interval"`
+
+	// Downstream responses slower than this are logged as warnings. Defaults to 1s; 0 never warns.
+	SlowDownstream duration `json:"slow_downstream"`
+
+	// How long to wait for a downstream service to acknowledge a request, after which clients
+	// that tagged the request are told it timed out. Defaults to 30s; 0 turns tags off, so every
+	// acknowledgement is broadcast.
+	RequestTimeout duration `json:"request_timeout"`
+
+	// How many requests for a downstream service that has dropped are held until it reconnects,
+	// then sent in order, so a brief outage doesn't lose them. Requests beyond that fail.
+	// Defaults to 16; 0 fails every request for it straight away.
+	ReconnectQueue int `json:"reconnect_queue"`
+
+	// Downstream services that send nothing for HealthInterval are probed, and marked unhealthy
+	// if they still send nothing for HealthTimeout; requests for them fail until they do.
+	// They default to 10s and 5s; a HealthInterval of 0 turns health checks off.
+	HealthInterval duration `json:"health_interval"`
+	HealthTimeout  duration `json:"health_timeout"`
+
+	// How often to send every client a heartbeat, so dead connections are noticed.
+	// Heartbeats count as activity, so if they're more often than IdleTimeout, idle clients
+	// are never disconnected.
+	HeartbeatInterval duration `json:"heartbeat_interval"`
+
+	// How often to log a line of stats (see stats.go). 0, the default, means never.
+	StatsInterval duration `json:"stats_interval"`
+
+	// How many requests a client can send that can't be understood before it is disconnected.
+	// 0 means no limit.
+	MaxBadRequests int `json:"max_bad_requests"`
+	// Longest line, in bytes, a client can send. Longer lines count as bad requests.
+	// Defaults to 64KiB.
+	MaxLineLength int `json:"max_line_length"`
+	// Most arguments a request can have. Requests with more count as bad requests.
+	// 0 means no limit, other than MaxLineLength. Defaults to 32.
+	MaxArgs int `json:"max_args"`
+
+	// Requests per second each client may send, in bursts of up to RequestBurst.
+	// A RequestRate of 0 means no limit.
+	RequestRate  float64 `json:"request_rate"`
+	RequestBurst int     `json:"request_burst"`
+	// Bytes per second of responses each client may be sent, in bursts of up to OutputBurst
+	// bytes. Responses over the limit are held back until it allows them if OutputPolicy is
+	// "delay" (the default), and dropped if it's "drop". An OutputRate of 0 means no limit.
+	OutputRate   float64 `json:"output_rate"`
+	OutputBurst  int     `json:"output_burst"`
+	OutputPolicy string  `json:"output_policy"`
+
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// If set, clients must present a certificate signed by one of the CAs in this file.
+	// The certificate's common name is the user they're authenticated as, as if with iam.
+	ClientCAFile string `json:"client_ca_file"`
+
+	// If AllowedCommands isn't empty, only the request words in it are accepted from clients.
+	// Request words in DeniedCommands are never accepted.
+	AllowedCommands []string `json:"allowed_commands"`
+	DeniedCommands  []string `json:"denied_commands"`
+
+	// Token for each user that may authenticate with iam.
+	// If there are none, clients don't need to authenticate.
+	Users map[string]string `json:"users"`
+	// Users who may send admin requests, such as list-clients.
+	Admins []string `json:"admins"`
+	// How many times a client can fail to authenticate before it's disconnected; 0 means no
+	// limit. Its IP address is then refused for AuthLockout, unless that is 0.
+	MaxFailedAuths int      `json:"max_failed_auths"`
+	AuthLockout    duration `json:"auth_lockout"`
+
+	// Words of the downstream responses whose latest one is sent to each new client, after the
+	// dump, so they know what they've missed. Defaults to FILE and DURATION, which say what's loaded.
+	CachedResponses []string `json:"cached_responses"`
+	// Words of the downstream responses never sent on to clients, though listd still acts on them.
+	SuppressedResponses []string `json:"suppressed_responses"`
+	// Words of the responses that are only sent to a client when nothing else is waiting to be,
+	// so a burst of them can't hold up more important ones. Each client has room for
+	// ResponseBuffer of them, on top of the rest. Defaults to TIME.
+	LowPriorityResponses []string `json:"low_priority_responses"`
+	// Words of the responses a client isn't sent if it's identical to the last one with that word
+	// it was sent, as when the downstream service repeats a STATE. Empty by default, so nothing is
+	// dropped. TIME can't be given, as a repeated position still says it hasn't moved.
+	DedupResponses []string `json:"dedup_responses"`
+
+	// Clients connecting from these addresses are disconnected straight away. Each is an IP
+	// address, or a CIDR range such as 10.0.0.0/8 or fd00::/8.
+	BannedAddrs []string `json:"banned_addrs"`
+	// If AllowedAddrs isn't empty, only clients connecting from addresses in it are accepted, as
+	// well as any on a Unix socket. Addresses are written as for BannedAddrs, which still apply.
+	AllowedAddrs []string `json:"allowed_addrs"`
+
+	// Where to write the access log, which records every request, broadcast response and reply to
+	// a tagged request, or "-" for stdout. Off if empty. AccessLogFormat is "json" (the default) or "text".
+	// Neither is reloaded until restart.
+	AccessLog       string `json:"access_log"`
+	AccessLogFormat string `json:"access_log_format"`
+
+	// Where to serve profiles for debugging over HTTP (see debug.go), as host:port. Off if
+	// empty, as it is by default. Anyone who can reach it can see inside listd, so it should be
+	// a loopback address. Not reloaded until restart.
+	DebugAddr string `json:"debug_addr"`
+	// Where to serve liveness and readiness checks over HTTP (see health.go), as host:port.
+	// Off if empty, as it is by default. Not reloaded until restart.
+	HealthAddr string `json:"health_addr"`
+
+	// LogLevel, BannedAddrs and AllowedAddrs, as parsed by validate.
+	logLevel    logLevel
+	bannedNets  []*net.IPNet
+	allowedNets []*net.IPNet
+}
+
+// Standalone modes, as for Config.Standalone.
+var STANDALONE_MODES = []string{"echo", "broadcast"}
+
+// Makes a config with the defaults used for anything not set in a file or on the command line.
+func defaultConfig() *Config {
+	return &Config{
+		Addr:          "127.0.0.1",
+		Port:          "1351",
+		PlayoutAddr:   "127.0.0.1",
+		PlayoutPort:   "1350",
+		ServerName:    LD_NAME,
+		ServerVersion: LD_VERSION,
+		LogLevel:      "info",
+		logLevel:      levelInfo,
+		MaxClients:    1024,
+
+		ResponseBuffer: 64,
+		MaxLineLength:  64 * 1024,
+		MaxArgs:        32,
+
+		RequestBurst: 10,
+		OutputBurst:  64 * 1024,
+		OutputPolicy: "delay",
+		TimeInterval: duration{500 * time.Millisecond},
+
+		SlowDownstream: duration{time.Second},
+		RequestTimeout: duration{30 * time.Second},
+		ReconnectQueue: 16,
+		HealthInterval: duration{10 * time.Second},
+		HealthTimeout:  duration{5 * time.Second},
+
+		CachedResponses:      []string{"FILE", "DURATION"},
+		LowPriorityResponses: []string{"TIME"},
+
+		AccessLogFormat: "json",
+	}
+}
+
+// Loads the JSON config file at path, on top of the defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open config file: %s", err.Error())
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Can't read config file %s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// Overrides the config with any LISTD_* environment variables that are set, as got by getenv
+// (normally os.Getenv). These sit between the config file and command line options.
+func applyEnv(cfg *Config, getenv func(string) string) (err error) {
+	strVars := map[string]*string{
+		"LISTD_ADDR":           &cfg.Addr,
+		"LISTD_PORT":           &cfg.Port,
+		"LISTD_PLAYOUT_ADDR":   &cfg.PlayoutAddr,
+		"LISTD_PLAYOUT_PORT":   &cfg.PlayoutPort,
+		"LISTD_SERVER_NAME":    &cfg.ServerName,
+		"LISTD_SERVER_VERSION": &cfg.ServerVersion,
+		"LISTD_LOG_LEVEL":      &cfg.LogLevel,
+		"LISTD_CERT_FILE":      &cfg.CertFile,
+		"LISTD_KEY_FILE":       &cfg.KeyFile,
+		"LISTD_CLIENT_CA_FILE": &cfg.ClientCAFile,
+		"LISTD_TCP_NODELAY":    &cfg.TCPNoDelay,
+		"LISTD_DEBUG_ADDR":     &cfg.DebugAddr,
+		"LISTD_HEALTH_ADDR":    &cfg.HealthAddr,
+	}
+	for name, field := range strVars {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	intVars := map[string]*int{
+		"LISTD_MAX_CLIENTS":          &cfg.MaxClients,
+		"LISTD_MAX_CLIENTS_PER_ADDR": &cfg.MaxClientsPerAddr,
+		"LISTD_MAX_CONNECTIONS":      &cfg.MaxConnections,
+		"LISTD_MAX_BAD_REQUESTS":     &cfg.MaxBadRequests,
+		"LISTD_MAX_LINE_LENGTH":      &cfg.MaxLineLength,
+		"LISTD_MAX_ARGS":             &cfg.MaxArgs,
+		"LISTD_RESPONSE_BUFFER":      &cfg.ResponseBuffer,
+		"LISTD_CHANNEL_BUFFER":       &cfg.ChannelBuffer,
+	}
+	for name, field := range intVars {
+		if v := getenv(name); v != "" {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("Invalid %s: %s", name, v)
+			}
+		}
+	}
+
+	durVars := map[string]*duration{
+		"LISTD_READ_TIMEOUT":       &cfg.ReadTimeout,
+		"LISTD_WRITE_TIMEOUT":      &cfg.WriteTimeout,
+		"LISTD_IDLE_TIMEOUT":       &cfg.IdleTimeout,
+		"LISTD_HEARTBEAT_INTERVAL": &cfg.HeartbeatInterval,
+		"LISTD_TIME_INTERVAL":      &cfg.TimeInterval,
+		"LISTD_STATS_INTERVAL":     &cfg.StatsInterval,
+		"LISTD_TCP_KEEPALIVE":      &cfg.TCPKeepAlive,
+	}
+	for name, field := range durVars {
+		if v := getenv(name); v != "" {
+			if field.Duration, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("Invalid %s: %s", name, v)
+			}
+		}
+	}
+	return
+}
+
+// Checks listd could listen on addr and port, as the config's Addr and Port, without trying to,
+// so a bad address is caught before anything starts, and said what's wrong with.
+// The port doesn't matter for Unix sockets. An empty addr listens on every interface, so only
+// the port is checked.
+func validateBind(addr string, port string) error {
+	if network, address := listenAddr(addr, port); network == "unix" {
+		if address == "" {
+			return fmt.Errorf("Invalid addr: socket path is empty")
+		}
+		return nil
+	}
+	if addr != "" {
+		if err := validateHost(addr); err != nil {
+			return fmt.Errorf("Invalid addr: %s", err.Error())
+		}
+	}
+	if err := validatePort(port); err != nil {
+		return fmt.Errorf("Invalid port: %s", err.Error())
+	}
+	return nil
+}
+
+// Checks host is an IP address (with a zone, for IPv6 link-local ones) or a well-formed host name.
+func validateHost(host string) error {
+	if ip := strings.SplitN(host, "%", 2)[0]; net.ParseIP(ip) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("%q is too long for a host name", host)
+	}
+	// A fully qualified name can end with a dot
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%q is not an IP address or host name", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("%q is not an IP address or host name", host)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks port is a number that can be used as a TCP port.
+func validatePort(port string) error {
+	if port == "" {
+		return fmt.Errorf("port is empty")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if p < 0 || p > 65535 {
+		return fmt.Errorf("%d is out of range", p)
+	}
+	return nil
+}
+
+// Checks whether clients may send requests with the command word, going by AllowedCommands and
+// DeniedCommands.
+func (cfg *Config) commandAllowed(word string) bool {
+	if len(cfg.AllowedCommands) > 0 && !containsString(cfg.AllowedCommands, word) {
+		return false
+	}
+	return !containsString(cfg.DeniedCommands, word)
+}
+
+// Parses IP addresses and CIDR ranges into networks. A lone address is a network of just itself.
+func parseNets(addrs []string) (nets []*net.IPNet, err error) {
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", a)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// Gets the IP address of addr, or nil if it isn't an IP address, as with Unix socket peers.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// Checks whether addr is an IP address in any of nets.
+func addrInNets(addr net.Addr, nets []*net.IPNet) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether clients connecting from addr are banned, going by BannedAddrs.
+func (cfg *Config) isBanned(addr net.Addr) bool {
+	return addrInNets(addr, cfg.bannedNets)
+}
+
+// Checks whether clients connecting from addr are allowed, going by AllowedAddrs.
+func (cfg *Config) isAllowed(addr net.Addr) bool {
+	if len(cfg.allowedNets) == 0 || addrIP(addr) == nil {
+		return true
+	}
+	return addrInNets(addr, cfg.allowedNets)
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks each connector can be connected to and routed to, and that no command is routed to more
+// than one of them.
+func validateConnectors(connectors []ConnectorConfig) error {
+	names := make(map[string]bool)
+	routed := make(map[string]string)
+	for _, c := range connectors {
+		if c.Name == "" || names[c.Name] {
+			return fmt.Errorf("name %q is empty or used twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.Addr == "" {
+			return fmt.Errorf("%s: address is empty", c.Name)
+		}
+		if err := validatePort(c.Port); err != nil {
+			return fmt.Errorf("%s: %s", c.Name, err.Error())
+		}
+		if len(c.Commands) == 0 {
+			return fmt.Errorf("%s: no commands", c.Name)
+		}
+		for _, cmd := range c.Commands {
+			if baps3.LookupWord(cmd).IsUnknown() {
+				return fmt.Errorf("%s: unknown command %q", c.Name, cmd)
+			}
+			if other, ok := routed[cmd]; ok {
+				return fmt.Errorf("%s: command %q already goes to %s", c.Name, cmd, other)
+			}
+			routed[cmd] = c.Name
+		}
+	}
+	return nil
+}
+
+// Checks the config makes sense, so mistakes are caught before anything starts.
+func (cfg *Config) validate() (err error) {
+	if err := validateBind(cfg.Addr, cfg.Port); err != nil {
+		return err
+	}
+	if cfg.PlayoutAddr == "" {
+		return fmt.Errorf("Invalid playout addr: address is empty")
+	}
+	if err := validatePort(cfg.PlayoutPort); err != nil {
+		return fmt.Errorf("Invalid playout port: %s", err.Error())
+	}
+	if err := validateConnectors(cfg.Connectors); err != nil {
+		return fmt.Errorf("Invalid connector: %s", err.Error())
+	}
+	if cfg.Standalone != "" && !containsString(STANDALONE_MODES, cfg.Standalone) {
+		return fmt.Errorf("Invalid standalone mode: %q", cfg.Standalone)
+	}
+	if cfg.Standalone != "" && len(cfg.Connectors) > 0 {
+		return fmt.Errorf("Can't have connectors in standalone mode")
+	}
+	if cfg.MaxClients < 1 {
+		return fmt.Errorf("Invalid max clients: %d", cfg.MaxClients)
+	}
+	if cfg.MaxClientsPerAddr < 0 {
+		return fmt.Errorf("Invalid max clients per addr: %d", cfg.MaxClientsPerAddr)
+	}
+	if cfg.MaxConnections < 0 {
+		return fmt.Errorf("Invalid max connections: %d", cfg.MaxConnections)
+	}
+	for _, t := range []duration{cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout, cfg.HeartbeatInterval, cfg.StatsInterval, cfg.TCPKeepAlive, cfg.TimeInterval, cfg.SlowDownstream, cfg.HealthInterval, cfg.HealthTimeout, cfg.RequestTimeout} {
+		if t.Duration < 0 {
+			return fmt.Errorf("Invalid timeout: %s", t)
+		}
+	}
+	if cfg.ResponseBuffer < 1 {
+		return fmt.Errorf("Invalid response buffer: %d", cfg.ResponseBuffer)
+	}
+	if cfg.ChannelBuffer < 0 {
+		return fmt.Errorf("Invalid channel buffer: %d", cfg.ChannelBuffer)
+	}
+	if cfg.MaxFailedAuths < 0 || cfg.AuthLockout.Duration < 0 {
+		return fmt.Errorf("Invalid auth limit: %d failures, locked out for %s", cfg.MaxFailedAuths, cfg.AuthLockout)
+	}
+	if cfg.MaxBadRequests < 0 {
+		return fmt.Errorf("Invalid max bad requests: %d", cfg.MaxBadRequests)
+	}
+	if cfg.MaxLineLength < 16 {
+		return fmt.Errorf("Invalid max line length: %d", cfg.MaxLineLength)
+	}
+	if cfg.MaxArgs < 0 {
+		return fmt.Errorf("Invalid max args: %d", cfg.MaxArgs)
+	}
+	if cfg.TCPNoDelay != "" && cfg.TCPNoDelay != "on" && cfg.TCPNoDelay != "off" {
+		return fmt.Errorf("Invalid TCP no delay: %q, want on or off", cfg.TCPNoDelay)
+	}
+	if containsString(cfg.DedupResponses, baps3.RsTime.String()) {
+		return fmt.Errorf("Invalid dedup responses: TIME responses can't be dropped")
+	}
+	if cfg.ReconnectQueue < 0 {
+		return fmt.Errorf("Invalid reconnect queue: %d", cfg.ReconnectQueue)
+	}
+	if cfg.MaxDropped < 0 {
+		return fmt.Errorf("Invalid max dropped: %d", cfg.MaxDropped)
+	}
+	if cfg.RequestRate < 0 || (cfg.RequestRate > 0 && cfg.RequestBurst < 1) {
+		return fmt.Errorf("Invalid request rate limit: %g per second, bursts of %d", cfg.RequestRate, cfg.RequestBurst)
+	}
+	if cfg.OutputRate < 0 || (cfg.OutputRate > 0 && cfg.OutputBurst < 1) {
+		return fmt.Errorf("Invalid output rate limit: %g bytes per second, bursts of %d", cfg.OutputRate, cfg.OutputBurst)
+	}
+	if cfg.OutputPolicy != "delay" && cfg.OutputPolicy != "drop" {
+		return fmt.Errorf("Invalid output policy: %q, want delay or drop", cfg.OutputPolicy)
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("Need both a cert file and a key file for TLS")
+	}
+	if cfg.DebugAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.DebugAddr); err != nil {
+			return fmt.Errorf("Invalid debug addr: %s", err.Error())
+		}
+	}
+	if cfg.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HealthAddr); err != nil {
+			return fmt.Errorf("Invalid health addr: %s", err.Error())
+		}
+	}
+	if !containsString(ACCESS_LOG_FORMATS, cfg.AccessLogFormat) {
+		return fmt.Errorf("Invalid access log format: %q", cfg.AccessLogFormat)
+	}
+	if cfg.ClientCAFile != "" && cfg.CertFile == "" {
+		return fmt.Errorf("Need a cert file and a key file for client certificates")
+	}
+	if cfg.bannedNets, err = parseNets(cfg.BannedAddrs); err != nil {
+		return fmt.Errorf("Invalid banned addr: %s", err.Error())
+	}
+	if cfg.allowedNets, err = parseNets(cfg.AllowedAddrs); err != nil {
+		return fmt.Errorf("Invalid allowed addr: %s", err.Error())
+	}
+	cfg.logLevel, err = parseLogLevel(cfg.LogLevel)
+	return
+}
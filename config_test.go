@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsBanned(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BannedAddrs = []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("TestIsBanned: returned err on validate (%s)", err.Error())
+	}
+
+	cases := []struct {
+		ip     string
+		banned bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.200", true},
+		{"::ffff:198.51.100.7", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, c := range cases {
+		addr := &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 1351}
+		if got := cfg.isBanned(addr); got != c.banned {
+			t.Errorf("TestIsBanned: %s banned %v, want %v", c.ip, got, c.banned)
+		}
+	}
+	if cfg.isBanned(&net.UnixAddr{Name: "/tmp/listd.sock", Net: "unix"}) {
+		t.Errorf("TestIsBanned: unix socket client banned")
+	}
+
+	cfg.BannedAddrs = []string{"not an address"}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("TestIsBanned: bad address validated, want err")
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("TestIsAllowed: returned err on validate (%s)", err.Error())
+	}
+	if !cfg.isAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Errorf("TestIsAllowed: address refused with no allow-list")
+	}
+
+	cfg.AllowedAddrs = []string{"10.0.0.0/8"}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("TestIsAllowed: returned err on validate (%s)", err.Error())
+	}
+	if !cfg.isAllowed(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Errorf("TestIsAllowed: address in allow-list refused")
+	}
+	if cfg.isAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Errorf("TestIsAllowed: address not in allow-list allowed")
+	}
+	if !cfg.isAllowed(&net.UnixAddr{Name: "/tmp/listd.sock", Net: "unix"}) {
+		t.Errorf("TestIsAllowed: unix socket client refused")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"LISTD_PORT":         "1400",
+		"LISTD_MAX_CLIENTS":  "10",
+		"LISTD_READ_TIMEOUT": "5m",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, getenv); err != nil {
+		t.Fatalf("TestApplyEnv: returned err (%s)", err.Error())
+	}
+	if cfg.Port != "1400" || cfg.MaxClients != 10 || cfg.ReadTimeout.Duration != 5*time.Minute {
+		t.Errorf("TestApplyEnv: got port %s, max clients %d, read timeout %s", cfg.Port, cfg.MaxClients, cfg.ReadTimeout.Duration)
+	}
+	if cfg.Addr != defaultConfig().Addr {
+		t.Errorf("TestApplyEnv: unset variable changed addr to %q", cfg.Addr)
+	}
+
+	env["LISTD_MAX_CLIENTS"] = "lots"
+	if err := applyEnv(defaultConfig(), getenv); err == nil {
+		t.Errorf("TestApplyEnv: bad max clients applied, want err")
+	}
+}
+
+func TestValidateBind(t *testing.T) {
+	cases := []struct {
+		addr, port string
+		ok         bool
+	}{
+		{"127.0.0.1", "1351", true},
+		{"::1", "1351", true},
+		{"fe80::1%eth0", "1351", true},
+		{"localhost", "0", true},
+		{"listd.example.com.", "1351", true},
+		{"/tmp/listd.sock", "", true},
+		{"127.0.0.1", "", false},
+		{"127.0.0.1", "65536", false},
+		{"127.0.0.1", "-1", false},
+		{"127.0.0.1", "http", false},
+		{"", "1351", true},
+		{"", "", false},
+		{"not a host", "1351", false},
+		{"[::1]", "1351", false},
+		{"-listd.example.com", "1351", false},
+		{"listd..example.com", "1351", false},
+		{"unix://", "", false},
+	}
+	for _, c := range cases {
+		if err := validateBind(c.addr, c.port); (err == nil) != c.ok {
+			t.Errorf("TestValidateBind: %q port %q returned err %v, want ok %v", c.addr, c.port, err, c.ok)
+		}
+	}
+}
+
+func TestValidateConnectors(t *testing.T) {
+	good := ConnectorConfig{Name: "studio2", Addr: "127.0.0.1", Port: "1360", Commands: []string{"play", "stop"}}
+	if err := validateConnectors([]ConnectorConfig{good}); err != nil {
+		t.Errorf("TestValidateConnectors: good connector returned err (%s)", err.Error())
+	}
+
+	twice := good
+	twice.Name = "studio3"
+	twice.Commands = []string{"stop"}
+	noCommands := good
+	noCommands.Commands = nil
+	unknown := good
+	unknown.Commands = []string{"dance"}
+	for _, connectors := range [][]ConnectorConfig{
+		{good, good},
+		{good, twice},
+		{noCommands},
+		{unknown},
+	} {
+		if err := validateConnectors(connectors); err == nil {
+			t.Errorf("TestValidateConnectors: %v accepted, want err", connectors)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+//
+// Debug server
+//
+// With Config.DebugAddr set, listd serves net/http/pprof's profiles over HTTP there, under
+// /debug/pprof/, so goroutine, heap and CPU profiles can be pulled from a running instance with
+// 'go tool pprof http://<addr>/debug/pprof/heap' and the like. The handlers go on their own mux.
+// Importing net/http/pprof also registers them on http.DefaultServeMux, so listd never serves
+// that (see startHTTPServer); programs embedding listd that serve it themselves expose them too.
+//
+
+// Makes the handler for the debug server.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Dialling downstream services
+//
+// listd is a baps3 client of the playout system and every other connector. dialTCP connects to
+// one over TCP, and waits for the OHAI and FEATURES every baps3 service greets its clients with
+// before handing the connection over. If either step fails, so does the dial, and the hub's
+// reconnect backs off and tries again (see handleDownstreamClosed).
+//
+
+// How long connecting to a downstream service, and it sending its OHAI and FEATURES, can take.
+const DIAL_TIMEOUT = 5 * time.Second
+
+// Makes a dialFunc connecting to the baps3 service at hostport over TCP.
+// Requests are written to it as they come down cReqCh, and what it sends back, starting with its
+// OHAI and FEATURES, comes up cResCh. Closing cReqCh closes the connection; cResCh is closed once
+// reading from it stops, which it does if it closes, or anything goes wrong with it.
+func dialTCP(hostport string, logger Logger) dialFunc {
+	return func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		conn, err := net.DialTimeout("tcp", hostport, DIAL_TIMEOUT)
+		if err != nil {
+			return nil, nil, err
+		}
+		r := bufio.NewReader(conn)
+		tok := baps3.NewTokeniser()
+
+		conn.SetReadDeadline(time.Now().Add(DIAL_TIMEOUT))
+		welcome, err := readHandshake(r, tok)
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("Bad handshake from %s: %s", hostport, err)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		reqCh := make(chan baps3.Message)
+		// Room for the welcome, so it's waiting there for the hub
+		resCh := make(chan baps3.Message, len(welcome))
+		for _, res := range welcome {
+			resCh <- res
+		}
+		closed := make(chan struct{})
+		go writeRequests(conn, reqCh, closed, logger)
+		go readResponses(conn, r, tok, resCh, closed, logger)
+		return reqCh, resCh, nil
+	}
+}
+
+// Reads what a service sends on connecting, up to and including its FEATURES.
+// It must start with an OHAI.
+func readHandshake(r *bufio.Reader, tok *baps3.Tokeniser) (welcome []baps3.Message, err error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		lines, _, err := tok.Tokenise(line)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			msg, err := baps3.LineToMessage(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(welcome) == 0 && msg.Word() != baps3.RsOhai {
+				return nil, fmt.Errorf("Expected OHAI, got %s", msg.Word())
+			}
+			welcome = append(welcome, *msg)
+			if msg.Word() == baps3.RsFeatures {
+				return welcome, nil
+			}
+		}
+	}
+}
+
+// Writes every request from reqCh to conn, until reqCh is closed, then closes closed, to say
+// closing conn is on purpose, and conn.
+// Once a write fails, conn is closed, which gets readResponses to stop, and the rest are dropped.
+func writeRequests(conn net.Conn, reqCh <-chan baps3.Message, closed chan<- struct{}, logger Logger) {
+	defer conn.Close()
+	defer close(closed)
+	failed := false
+	for req := range reqCh {
+		if failed {
+			continue
+		}
+		packed, err := req.Pack()
+		if err != nil {
+			logger.Error("Couldn't pack request", req.String(), ":", err.Error())
+			continue
+		}
+		if _, err := conn.Write(packed); err != nil {
+			logger.Warn("Error writing to", conn.RemoteAddr(), ":", err.Error())
+			conn.Close()
+			failed = true
+		}
+	}
+}
+
+// Sends every response read from conn up resCh, until reading fails, then closes resCh.
+// Gives up sending once closed is, as nothing is reading resCh any more.
+func readResponses(conn net.Conn, r *bufio.Reader, tok *baps3.Tokeniser, resCh chan<- baps3.Message, closed <-chan struct{}, logger Logger) {
+	defer close(resCh)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			select {
+			case <-closed:
+				// Expected, as the connection was closed on purpose
+			default:
+				logger.Warn("Error reading from", conn.RemoteAddr(), ":", err.Error())
+			}
+			return
+		}
+		lines, _, err := tok.Tokenise(line)
+		if err != nil {
+			logger.Warn("Bad response from", conn.RemoteAddr(), ":", err.Error())
+			continue
+		}
+		for _, line := range lines {
+			msg, err := baps3.LineToMessage(line)
+			if err != nil {
+				logger.Warn("Bad response from", conn.RemoteAddr(), ":", err.Error())
+				continue
+			}
+			select {
+			case resCh <- *msg:
+			case <-closed:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Listens for one connection, which is greeted with welcome, then handed to serve.
+// Returns where to dial.
+func serveTestService(t *testing.T, welcome string, serve func(net.Conn, *bufio.Reader)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("serveTestService: returned err on listen (%s)", err.Error())
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(welcome))
+		serve(conn, bufio.NewReader(conn))
+	}()
+	return l.Addr().String()
+}
+
+func TestDialTCP(t *testing.T) {
+	got := make(chan string, 1)
+	addr := serveTestService(t, "OHAI 'test'\nFEATURES\n", func(conn net.Conn, r *bufio.Reader) {
+		line, _ := r.ReadString('\n')
+		got <- line
+		conn.Write([]byte("STATE Playing\n"))
+		// Waits for listd to hang up
+		r.ReadString('\n')
+	})
+
+	reqCh, resCh, err := dialTCP(addr, newStdLogger(levelError))()
+	if err != nil {
+		t.Fatalf("TestDialTCP: returned err on dial (%s)", err.Error())
+	}
+	for _, want := range []baps3.MessageWord{baps3.RsOhai, baps3.RsFeatures} {
+		if res := <-resCh; res.Word() != want {
+			t.Errorf("TestDialTCP: got %q, want %s", res.String(), want)
+		}
+	}
+
+	reqCh <- *baps3.NewMessage(baps3.RqPlay)
+	if line := <-got; line != "play\n" {
+		t.Errorf("TestDialTCP: service got %q, want %q", line, "play\n")
+	}
+	select {
+	case res := <-resCh:
+		if res.String() != "STATE Playing" {
+			t.Errorf("TestDialTCP: got %q, want %q", res.String(), "STATE Playing")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestDialTCP: no response")
+	}
+
+	close(reqCh)
+	select {
+	case _, more := <-resCh:
+		if more {
+			t.Errorf("TestDialTCP: got a response after closing")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestDialTCP: resCh not closed after closing reqCh")
+	}
+}
+
+// A service that doesn't start with an OHAI can't be dialled.
+func TestDialTCPBadHandshake(t *testing.T) {
+	addr := serveTestService(t, "STATE Playing\n", func(net.Conn, *bufio.Reader) {})
+	if _, _, err := dialTCP(addr, newStdLogger(levelError))(); err == nil {
+		t.Errorf("TestDialTCPBadHandshake: no err dialling a service without an OHAI")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+)
+
+//
+// Client events
+//
+// Programs embedding listd can be told about clients coming and going, by giving InitServer
+// WithEvents. Events are only sent if there's room in the channel, so a slow subscriber can't
+// hold up the server; it just misses events. Without WithEvents, nothing is sent.
+//
+
+// What happened to a client.
+type EventKind string
+
+const (
+	EventConnect    EventKind = "connect"
+	EventDisconnect EventKind = "disconnect"
+	// Sent when an admin kicks a client, just before its disconnect event.
+	EventKick EventKind = "kick"
+)
+
+// Something that happened to a client, identified by its ID (as in list-clients) and address.
+// Reason is only set for kicks, and only if the admin gave one.
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	ClientID uint64
+	Addr     string
+	Reason   string
+}
+
+// Sends an event about c to the events channel, unless there isn't one or it's full.
+// Only used from within runListener's loop.
+func (h *hub) publish(kind EventKind, c *Client, reason string) {
+	if h.events == nil {
+		return
+	}
+	ev := Event{kind, time.Now(), c.id, c.RemoteAddr().String(), reason}
+	select {
+	case h.events <- ev:
+	default:
+		h.logger.Debug("Dropped", kind, "event for", c, "as nobody's listening")
+	}
+}
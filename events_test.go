@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 2)
+	h := makeTestHub()
+	h.events = events
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	admin, adminOther := makeTestClient(h)
+	defer adminOther.Close()
+	admin.user = "admin"
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := h.newClient(conn)
+	h.addClient(c)
+
+	// The disconnect doesn't fit, so is dropped rather than holding up the kick
+	h.processLocalRequest(admin, []string{"kick", strconv.FormatUint(c.id, 10), "spamming"})
+	if n := len(events); n != 2 {
+		t.Fatalf("TestEvents: %d events, want 2", n)
+	}
+	if ev := <-events; ev.Kind != EventConnect || ev.ClientID != c.id || ev.Addr != "pipe" {
+		t.Errorf("TestEvents: got %+v, want a connect from #%d pipe", ev, c.id)
+	}
+	if ev := <-events; ev.Kind != EventKick || ev.ClientID != c.id || ev.Reason != "spamming" {
+		t.Errorf("TestEvents: got %+v, want #%d kicked for spamming", ev, c.id)
+	}
+}
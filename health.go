@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+//
+// Health checks
+//
+// With Config.HealthAddr set, listd serves two endpoints over HTTP there, for orchestrators such
+// as Kubernetes to probe. /healthz (liveness) is OK while listd is accepting connections.
+// /readyz (readiness) is only OK while it is, isn't draining, and every connector is healthy (see
+// connector-status), so clients aren't sent to a listd that can't reach its playout system, or
+// is about to go away.
+// Anything else gets 503 Service Unavailable.
+//
+
+// Checks whether the server is accepting connections. Safe to call from any goroutine.
+func (s *Server) Live() bool {
+	return atomic.LoadInt32(&s.h.accepting) == 1
+}
+
+// Checks whether the server is accepting connections, isn't draining, and can pass requests on
+// to every connector. Safe to call from any goroutine.
+func (s *Server) Ready() bool {
+	return s.Live() && !s.h.isDraining() && atomic.LoadInt32(&s.h.connectorsReady) == 1
+}
+
+// Records whether every connector is available, for Ready. Always true when standalone.
+// Only used from within runListener's loop.
+func (h *hub) storeReady() {
+	ready := int32(1)
+	if h.config.Standalone == "" {
+		for _, conn := range h.connectors {
+			if !conn.available() {
+				ready = 0
+				break
+			}
+		}
+	}
+	atomic.StoreInt32(&h.connectorsReady, ready)
+}
+
+// Makes the handler for the health server.
+func healthHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthCheck(s.Live, "Not accepting connections"))
+	mux.HandleFunc("/readyz", healthCheck(s.Ready, "Not ready"))
+	return mux
+}
+
+// Makes a handler answering OK while ok does, and 503 with reason otherwise.
+func healthCheck(ok func() bool, reason string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ok() {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}
+}
+
+// Starts serving handler over HTTP on addr, in the background, logging that it's serving what.
+// The caller should close the returned server once it's finished with it. handler mustn't be nil,
+// as that would serve http.DefaultServeMux, and with it the profiles (see debug.go).
+func startHTTPServer(what string, addr string, handler http.Handler, logger Logger) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logger.Error("HTTP server for", what, "stopped:", err.Error())
+		}
+	}()
+	logger.Info("Serving", what, "on http://"+l.Addr().String())
+	return srv, nil
+}
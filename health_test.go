@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Gets the status code the health handler gives path.
+func getHealth(s *Server, path string) int {
+	rec := httptest.NewRecorder()
+	healthHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestHealthChecks(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	dial := func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		return make(chan baps3.Message), make(chan baps3.Message), nil
+	}
+	s := InitServer(cfg, dial)
+	if getHealth(s, "/healthz") != http.StatusServiceUnavailable || getHealth(s, "/readyz") != http.StatusServiceUnavailable {
+		t.Errorf("TestHealthChecks: healthy before serving")
+	}
+
+	go s.ListenAndServe()
+	s.Addr()
+	for i := 0; !s.Ready(); i++ {
+		if i == 100 {
+			t.Fatalf("TestHealthChecks: not ready once serving")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if getHealth(s, "/healthz") != http.StatusOK || getHealth(s, "/readyz") != http.StatusOK {
+		t.Errorf("TestHealthChecks: health checks failing while serving")
+	}
+
+	s.Shutdown(context.Background())
+	if s.Live() {
+		t.Errorf("TestHealthChecks: still live after shutdown")
+	}
+}
+
+// A server whose playout system is unhealthy is live, but not ready.
+func TestHealthChecksUnhealthy(t *testing.T) {
+	s := InitServer(defaultConfig(), nil)
+	s.h.setConnector(make(chan baps3.Message), make(chan baps3.Message))
+	s.h.downstream.unhealthy = true
+	s.h.accepting = 1
+	s.h.storeReady()
+
+	if code := getHealth(s, "/healthz"); code != http.StatusOK {
+		t.Errorf("TestHealthChecksUnhealthy: /healthz got %d, want %d", code, http.StatusOK)
+	}
+	if code := getHealth(s, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("TestHealthChecksUnhealthy: /readyz got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+// A draining server is live, but not ready, until it stops draining.
+func TestHealthChecksDraining(t *testing.T) {
+	s := InitServer(defaultConfig(), nil, WithStandalone("echo"))
+	s.h.accepting = 1
+	s.h.storeReady()
+
+	s.Drain(true)
+	if s.Ready() || !s.Live() {
+		t.Errorf("TestHealthChecksDraining: ready %v and live %v while draining, want only live", s.Ready(), s.Live())
+	}
+	s.Drain(false)
+	if !s.Ready() {
+		t.Errorf("TestHealthChecksDraining: not ready after draining stopped")
+	}
+}
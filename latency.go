@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Downstream latency
+//
+// baps3 responses don't say which request they answer, so requests sent downstream are matched
+// to responses by word: acknowledgements name the request they're for, and otherwise each request
+// has a response that shows it has been acted on (STATE for play, say). The oldest outstanding
+// request with that word is taken to be the one answered.
+//
+
+// The response that shows a request without an acknowledgement has been acted on.
+var LATENCY_RESPONSES = map[baps3.MessageWord]baps3.MessageWord{
+	baps3.RqPlay:  baps3.RsState,
+	baps3.RqStop:  baps3.RsState,
+	baps3.RqEject: baps3.RsState,
+	baps3.RqSeek:  baps3.RsTime,
+	baps3.RqLoad:  baps3.RsFile,
+}
+
+// Requests unanswered for this long are assumed never to be, and forgotten.
+const MAX_PENDING_AGE = time.Minute
+
+// Upper bounds of the latency histogram's buckets. Anything slower goes in one last bucket.
+var LATENCY_BUCKETS = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Counts downstream latencies into LATENCY_BUCKETS, plus one bucket for anything slower.
+// The counts are accessed atomically, so can be read from any goroutine.
+type latencyHistogram struct {
+	counts []uint64
+}
+
+func (lh *latencyHistogram) record(d time.Duration) {
+	i := 0
+	for i < len(LATENCY_BUCKETS) && d > LATENCY_BUCKETS[i] {
+		i++
+	}
+	atomic.AddUint64(&lh.counts[i], 1)
+}
+
+// Gets how many latencies have gone in each bucket so far.
+func (lh *latencyHistogram) Counts() []uint64 {
+	counts := make([]uint64, len(lh.counts))
+	for i := range lh.counts {
+		counts[i] = atomic.LoadUint64(&lh.counts[i])
+	}
+	return counts
+}
+
+// Tracks requests sent downstream until they are answered. Only used from within runListener's loop.
+type latencyTracker struct {
+	// When each outstanding request was sent, oldest first, by request word.
+	pending map[baps3.MessageWord][]time.Time
+	hist    latencyHistogram
+}
+
+func initLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		pending: make(map[baps3.MessageWord][]time.Time),
+		hist:    latencyHistogram{counts: make([]uint64, len(LATENCY_BUCKETS)+1)},
+	}
+}
+
+// Records that req has just been sent downstream.
+func (lt *latencyTracker) sent(req baps3.Message) {
+	now := time.Now()
+	sent := lt.pending[req.Word()]
+	for len(sent) > 0 && now.Sub(sent[0]) > MAX_PENDING_AGE {
+		sent = sent[1:]
+	}
+	lt.pending[req.Word()] = append(sent, now)
+}
+
+// Works out which request word res answers, if any.
+func answeredWord(res baps3.Message) (word baps3.MessageWord, ok bool) {
+	var arg string
+	switch res.Word() {
+	case baps3.RsOk:
+		arg, _ = res.Arg(0)
+	case baps3.RsFail, baps3.RsWhat:
+		arg, _ = res.Arg(1)
+	default:
+		return
+	}
+	word = baps3.LookupWord(arg)
+	return word, !word.IsUnknown()
+}
+
+// Matches res with the oldest outstanding request it answers, returning how long that took.
+// ok is false if res doesn't answer anything outstanding.
+func (lt *latencyTracker) received(res baps3.Message) (answered baps3.MessageWord, latency time.Duration, ok bool) {
+	if word, isAck := answeredWord(res); isAck {
+		answered = word
+	} else {
+		// Without an acknowledgement, take the oldest request this response could be for
+		var oldest time.Time
+		for reqWord, resWord := range LATENCY_RESPONSES {
+			sent := lt.pending[reqWord]
+			if resWord == res.Word() && len(sent) > 0 && (oldest.IsZero() || sent[0].Before(oldest)) {
+				answered, oldest = reqWord, sent[0]
+			}
+		}
+	}
+
+	sent := lt.pending[answered]
+	if len(sent) == 0 {
+		return answered, 0, false
+	}
+	lt.pending[answered] = sent[1:]
+	latency = time.Since(sent[0])
+	lt.hist.record(latency)
+	return answered, latency, true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	lt := initLatencyTracker()
+	lt.sent(*baps3.NewMessage(baps3.RqPlay))
+	lt.sent(*baps3.NewMessage(baps3.RqSeek).AddArg("1000"))
+
+	// Acknowledgements say what they answer
+	if word, _, ok := lt.received(*baps3.NewMessage(baps3.RsOk).AddArg("seek")); !ok || word != baps3.RqSeek {
+		t.Errorf("TestLatencyTracker: OK seek matched %v (%v), want seek", word, ok)
+	}
+	// Other responses are matched by what they show happened
+	if word, _, ok := lt.received(*baps3.NewMessage(baps3.RsState).AddArg("Playing")); !ok || word != baps3.RqPlay {
+		t.Errorf("TestLatencyTracker: STATE matched %v (%v), want play", word, ok)
+	}
+	// Nothing is outstanding now
+	if word, _, ok := lt.received(*baps3.NewMessage(baps3.RsState).AddArg("Stopped")); ok {
+		t.Errorf("TestLatencyTracker: STATE matched %v with nothing outstanding", word)
+	}
+
+	var total uint64
+	for _, n := range lt.hist.Counts() {
+		total += n
+	}
+	if total != 2 {
+		t.Errorf("TestLatencyTracker: histogram has %d latencies, want 2", total)
+	}
+}
+
+func TestLatencyHistogramBuckets(t *testing.T) {
+	lt := initLatencyTracker()
+	lt.hist.record(3 * time.Millisecond)
+	lt.hist.record(time.Minute)
+
+	counts := lt.hist.Counts()
+	if counts[1] != 1 || counts[len(counts)-1] != 1 {
+		t.Errorf("TestLatencyHistogramBuckets: got %v, want one in the 5ms bucket and one in the last", counts)
+	}
+}
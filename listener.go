@@ -1,24 +1,88 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"reflect"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	baps3 "github.com/UniversityRadioYork/baps3-go"
 )
 
+// A request from a client. If it is a local request (see commands.go), local holds its words
+// and msg is unset. If it couldn't be understood at all, err holds why and the rest are unset.
+// tag is what the client tagged it with (see tags.go), if anything.
 type clientAndMessage struct {
-	c   *Client
-	msg baps3.Message
+	c     *Client
+	msg   baps3.Message
+	local []string
+	tag   string
+	err   error
+}
+
+// Gets the words of the request, as sent by the client.
+func (cm clientAndMessage) words() []string {
+	if cm.local != nil {
+		return cm.local
+	}
+	return cm.msg.AsSlice()
 }
 
 // Maintains communications with the downstream service and connected clients.
 // Also does any processing needed with the commands.
 type hub struct {
-	// All current clients.
+	// All current clients. Keyed by the Client itself rather than its conn, so a client is
+	// always found again however its conn is wrapped (by TLS, say). Each resCh is on its Client.
 	clients map[*Client]bool
 
+	// len(clients), kept so other goroutines can read it atomically (see ClientCount).
+	numClients int64
+
+	// Running totals for the stats (see stats.go), only accessed atomically.
+	counts hubCounts
+
+	// How many clients are registered from each IP address (see clientAddrKey).
+	clientsPerAddr map[string]int
+
+	// IP addresses locked out for failing to authenticate, and until when.
+	lockouts map[string]time.Time
+
+	// Every goroutine runListener starts for accepting and serving connections, registered or
+	// not, so it can wait for them all to finish on shutdown.
+	connWg sync.WaitGroup
+
+	// Limits, timeouts and so on, as given to runListener. Only touched by the hub's loop;
+	// other goroutines get it with currentConfig. New configs come through reloadCh.
+	config       *Config
+	sharedConfig atomic.Value
+	reloadCh     chan *Config
+
+	// Where log messages go, for the hub and its clients.
+	logger Logger
+	// Where requests and responses are recorded, if not nil.
+	accessLog *accessLogger
+	// Where events about clients are sent, if not nil (see events.go).
+	events chan<- Event
+
+	// When runListener started.
+	started time.Time
+	// What client connections are encrypted with, if anything.
+	tlsConfig *tls.Config
+	// What runListener is listening on, which is only set once listening is closed.
+	addr      net.Addr
+	listening chan struct{}
+
 	// Downstream service state
 	downstreamState baps3.ServiceState
 
@@ -27,9 +91,43 @@ type hub struct {
 	// Playlist instance
 	pl *Playlist
 
-	// For communication with the downstream service.
-	cReqCh chan<- baps3.Message
-	cResCh <-chan baps3.Message
+	// The latest downstream response with each of config.CachedResponses' words.
+	responseCache map[string]baps3.Message
+
+	// For throttling TIME responses: when one was last broadcast, the latest one held back
+	// since (if any), and when to broadcast it (nil if nothing is held back).
+	lastTime    time.Time
+	pendingTime *baps3.Message
+	timeFlushCh <-chan time.Time
+
+	// How long the downstream service takes to answer requests.
+	latency *latencyTracker
+	// Who sent the requests still waiting for acknowledgements, and with what tags.
+	tags *tagTracker
+	// What every request goes through before dispatchRequest; see middleware.go.
+	middleware []Middleware
+	// Which of RUNTIME_FEATURES set-feature has turned off.
+	featuresOff map[string]bool
+
+	// Whether acceptConnections is running, and whether every connector was available at
+	// the end of runListener's loop's last go round, as 1 or 0, for health checks (see health.go).
+	// Both are only accessed atomically.
+	accepting       int32
+	connectorsReady int32
+	// 1 while draining (see setDraining), so new clients are refused. Only accessed atomically.
+	draining int32
+
+	// For communication with the downstream services. downstream is the playout system, which
+	// gets every forwarded request except those whose word routes sends to another connector.
+	// connectors has every connector, downstream first.
+	downstream *connector
+	connectors []*connector
+	routes     map[baps3.MessageWord]*connector
+
+	// Responses from every connector come through downResCh, from forwardResponses.
+	// New connections, made when a connector drops, come back through connCh.
+	downResCh chan connectorResponse
+	connCh    chan downstreamConn
 
 	// Where new requests from clients come through.
 	reqCh chan clientAndMessage
@@ -37,24 +135,166 @@ type hub struct {
 	// Handlers for adding/removing connections.
 	addCh chan *Client
 	rmCh  chan *Client
-	Quit  chan bool
 }
 
-// Handles a new client connection.
-// conn is the new connection object.
-func (h *hub) handleNewConnection(conn net.Conn) {
-	defer conn.Close()
+// Gets the config the hub is using. Unlike h.config, safe to call from any goroutine.
+func (h *hub) currentConfig() *Config {
+	return h.sharedConfig.Load().(*Config)
+}
+
+// Switches the hub to cfg, which should already be validated. The addresses listd listens on and
+// connects to (including connectors, and whether it's standalone), and TLS, can't change without restarting, so are kept from the old config.
+// Clients already connected keep their old timeouts and limits.
+// Must only be called from within runListener's loop.
+func (h *hub) reloadConfig(cfg *Config) {
+	old := h.config
+	if cfg.Addr != old.Addr || cfg.Port != old.Port || cfg.PlayoutAddr != old.PlayoutAddr ||
+		cfg.PlayoutPort != old.PlayoutPort || cfg.CertFile != old.CertFile || cfg.KeyFile != old.KeyFile ||
+		cfg.ClientCAFile != old.ClientCAFile || !reflect.DeepEqual(cfg.Connectors, old.Connectors) || cfg.Standalone != old.Standalone ||
+		cfg.DebugAddr != old.DebugAddr || cfg.HealthAddr != old.HealthAddr {
+		h.logger.Warn("Addresses and TLS can't be reloaded, so keeping the old ones until restart")
+	}
+	cfg.Addr, cfg.Port, cfg.PlayoutAddr, cfg.PlayoutPort = old.Addr, old.Port, old.PlayoutAddr, old.PlayoutPort
+	cfg.Connectors, cfg.Standalone = old.Connectors, old.Standalone
+	cfg.DebugAddr, cfg.HealthAddr = old.DebugAddr, old.HealthAddr
+	// The channels, and acceptConnections' limit on connections, are already made
+	cfg.ChannelBuffer, cfg.MaxConnections = old.ChannelBuffer, old.MaxConnections
+	cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile = old.CertFile, old.KeyFile, old.ClientCAFile
+
+	h.config = cfg
+	h.sharedConfig.Store(cfg)
+	if l, ok := h.logger.(*stdLogger); ok {
+		l.setMinLevel(cfg.logLevel)
+	}
+	h.logger.Info("Reloaded config")
+}
+
+// Makes a client for a new connection, conn, set up as configured.
+// The client isn't registered with the hub until it is served with serveClient.
+func (h *hub) newClient(conn net.Conn) *Client {
+	cfg := h.currentConfig()
 	client := &Client{
-		conn:  conn,
-		resCh: make(chan baps3.Message),
-		tok:   baps3.NewTokeniser(),
+		id:           nextClientID(),
+		connected:    time.Now(),
+		conn:         conn,
+		logger:       h.logger,
+		resCh:        make(chan response, cfg.ResponseBuffer),
+		lowCh:        make(chan response, cfg.ResponseBuffer),
+		tok:          baps3.NewTokeniser(),
+		readTimeout:  cfg.ReadTimeout.Duration,
+		writeTimeout: cfg.WriteTimeout.Duration,
+		wantsTime:    true,
+
+		maxBadRequests: cfg.MaxBadRequests,
+		maxLineLength:  cfg.MaxLineLength,
+		maxArgs:        cfg.MaxArgs,
+	}
+	if cfg.RequestRate > 0 {
+		client.limiter = newTokenBucket(cfg.RequestRate, cfg.RequestBurst)
+	}
+	if cfg.OutputRate > 0 {
+		client.shaper = newTokenBucket(cfg.OutputRate, cfg.OutputBurst)
+		client.dropShaped = cfg.OutputPolicy == "drop"
 	}
+	client.touch()
+	return client
+}
+
+// Handles a new client connection.
+// conn is the new connection object, as accepted. Gives up on it once ctx is cancelled.
+// Its PROXY header (if configured, see proxy.go) is read first, then its address is checked,
+// then it's handshaken if serving TLS; it's rejected if any of those fail.
+func (h *hub) handleNewConnection(ctx context.Context, conn net.Conn) {
+	h.tuneConn(conn)
+	cfg := h.currentConfig()
+	if cfg.ProxyProtocol {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			h.logger.Warn("Refused connection from", conn.RemoteAddr(), "without a good PROXY header:", err.Error())
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	// Checked before anything is sent, so refused clients don't even get an OHAI
+	if cfg.isBanned(conn.RemoteAddr()) {
+		h.logger.Warn("Refused connection from banned address", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !cfg.isAllowed(conn.RemoteAddr()) {
+		h.logger.Warn("Refused connection from address not allowed", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	if h.tlsConfig != nil {
+		conn = tls.Server(conn, h.tlsConfig)
+	}
+	client := h.newClient(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := h.handshake(client, tlsConn); err != nil {
+			h.logger.Warn("TLS handshake with", client, "failed:", err.Error())
+			conn.Close()
+			return
+		}
+	}
+	h.serveClient(ctx, client)
+}
+
+// Sets up the TCP options configured for a new client connection, if it's over TCP.
+func (h *hub) tuneConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	cfg := h.currentConfig()
+	if period := cfg.TCPKeepAlive.Duration; period > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(period)
+	}
+	if cfg.TCPNoDelay != "" {
+		tcpConn.SetNoDelay(cfg.TCPNoDelay == "on")
+	}
+}
+
+// Registers client with the hub, then passes its requests to the hub and its responses back,
+// until either end disconnects or ctx is cancelled. Closes the client's connection on return.
+// The connection needn't have been accepted by runListener; tests use net.Pipe.
+func (h *hub) serveClient(ctx context.Context, client *Client) {
+	defer client.conn.Close()
+	defer h.recoverClient(ctx, client)
 
 	// Register user
-	h.addCh <- client
+	select {
+	case h.addCh <- client:
+	case <-ctx.Done():
+		return
+	}
+
+	h.connWg.Add(1)
+	go func() {
+		defer h.connWg.Done()
+		defer h.recoverClient(ctx, client)
+		client.Read(ctx, h.reqCh, h.rmCh)
+	}()
+	client.Write(ctx, client.resCh, h.rmCh)
+}
 
-	go client.Read(h.reqCh, h.rmCh)
-	client.Write(client.resCh, h.rmCh)
+// Recovers from a panic while serving client, so one bad connection doesn't take down the rest.
+// The panic is logged with its stack, and the client is unregistered.
+// Must be deferred directly by the goroutine serving the client.
+func (h *hub) recoverClient(ctx context.Context, client *Client) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	h.logger.Error("Panic serving", client, ":", r, "\n"+string(debug.Stack()))
+	select {
+	case h.rmCh <- client:
+	case <-ctx.Done():
+	}
 }
 
 //
@@ -65,20 +305,45 @@ func makeBadCommandMsgs() []*baps3.Message {
 	return []*baps3.Message{baps3.NewMessage(baps3.RsWhat).AddArg("Bad command")}
 }
 
-// Appends the downstream service's version (from the OHAI) to the listd version.
+// Appends the downstream service's version (from the OHAI) to the configured server name and version.
 func (h *hub) makeRsOhai() *baps3.Message {
-	return baps3.NewMessage(baps3.RsOhai).AddArg("listd " + LD_VERSION + "/" + h.downstreamState.Identifier)
+	return baps3.NewMessage(baps3.RsOhai).AddArg(h.config.ServerName + " " + h.config.ServerVersion + "/" + h.downstreamState.Identifier)
+}
+
+// Features listd provides itself, on top of the downstream service's.
+var LISTD_FEATURES = []baps3.Feature{
+	baps3.FtPlaylist,
+	baps3.FtPlaylistTextItems,
+	baps3.FtPlaylistAutoAdvance,
+}
+
+// Downstream features listd intercepts, so doesn't pass on to clients.
+var MASKED_FEATURES = []baps3.Feature{
+	baps3.FtFileLoad,
 }
 
-// Crafts the features message by adding listd's features to the downstream service's and removing
-// features listd intercepts.
-func (h *hub) makeRsFeatures() (msg *baps3.Message) {
+// Features of listd's own that aren't baps3 features, so are added to the FEATURES by name.
+// Everyone can turn on sequence numbers, but only admins get Admin, for the admin requests.
+const (
+	SEQUENCE_FEATURE = "Sequence"
+	ADMIN_FEATURE    = "Admin"
+)
+
+// Crafts the features message for c by adding listd's features to the downstream service's and
+// removing features listd intercepts. What c gets depends on who it authenticated as, so clients
+// that haven't get the same as everyone else, and are sent theirs again once they have (see iam).
+func (h *hub) makeRsFeatures(c *Client) (msg *baps3.Message) {
 	features := h.downstreamState.Features
-	features.DelFeature(baps3.FtFileLoad) // 'Mask' the features listd intercepts
-	features.AddFeature(baps3.FtPlaylist)
-	features.AddFeature(baps3.FtPlaylistTextItems)
-	features.AddFeature(baps3.FtPlaylistAutoAdvance)
-	msg = features.ToMessage()
+	for _, f := range MASKED_FEATURES {
+		features.DelFeature(f)
+	}
+	for _, f := range LISTD_FEATURES {
+		features.AddFeature(f)
+	}
+	msg = features.ToMessage().AddArg(SEQUENCE_FEATURE)
+	if h.isAdmin(c) {
+		msg.AddArg(ADMIN_FEATURE)
+	}
 	return
 }
 
@@ -119,11 +384,11 @@ func (h *hub) makeListResponses() (msgs []*baps3.Message) {
 	return
 }
 
-func sendInvalidCmd(c *Client, errRes baps3.Message, oldCmd baps3.Message) {
-	for _, w := range oldCmd.AsSlice() {
+func (h *hub) sendInvalidCmd(c *Client, errRes baps3.Message, oldCmd []string) {
+	for _, w := range oldCmd {
 		errRes.AddArg(w)
 	}
-	c.resCh <- errRes
+	h.send(c, errRes)
 }
 
 func (h *hub) processReqDequeue(req baps3.Message) (resps []*baps3.Message) {
@@ -186,7 +451,7 @@ func (h *hub) processReqSelect(req baps3.Message) (resps []*baps3.Message) {
 	if len(args) == 0 {
 		if h.pl.HasSelection() {
 			// Remove current selection
-			h.cReqCh <- *baps3.NewMessage(baps3.RqEject)
+			h.sendDownstream(*baps3.NewMessage(baps3.RqEject))
 			h.pl.selection = -1
 			resps = append(resps, baps3.NewMessage(baps3.RsSelect))
 		} else {
@@ -206,7 +471,7 @@ func (h *hub) processReqSelect(req baps3.Message) (resps []*baps3.Message) {
 			return append(resps, baps3.NewMessage(baps3.RsFail).AddArg(err.Error()))
 		}
 
-		h.cReqCh <- *baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data)
+		h.sendDownstream(*baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data))
 		resps = append(resps, baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(newIdx)).AddArg(newHash))
 	} else {
 		resps = makeBadCommandMsgs()
@@ -254,23 +519,51 @@ var REQ_FUNC_MAP = map[baps3.MessageWord]func(*hub, baps3.Message) []*baps3.Mess
 	baps3.RqAutoAdvance: (*hub).processReqAutoadvance,
 }
 
+// Requests listd passes on to the downstream service untouched.
+var FORWARDED_REQS = map[baps3.MessageWord]bool{
+	baps3.RqPlay: true,
+	baps3.RqStop: true,
+	baps3.RqSeek: true,
+}
+
 // Handles a request from a client.
-// Falls through to the connector cReqCh if command is "not understood".
-func (h *hub) processRequest(c *Client, req baps3.Message) {
-	log.Println("New request:", req.String())
-	if reqFunc, ok := REQ_FUNC_MAP[req.Word()]; ok {
+// Falls through to a connector if command is routed to one, or is one listd forwards to the
+// playout system, and is refused otherwise.
+func (h *hub) processRequest(c *Client, req baps3.Message, tag string) {
+	h.logger.Debug("New request from", c, ":", req.String())
+	if _, ok := h.routes[req.Word()]; ok {
+		h.forward(c, req, tag)
+	} else if reqFunc, ok := REQ_FUNC_MAP[req.Word()]; ok {
 		responses := reqFunc(h, req)
+		var broadcasts []*baps3.Message
 		for _, resp := range responses {
 			// TODO: Add a "is fail word" func to baps3-go?
 			if resp.Word() == baps3.RsFail || resp.Word() == baps3.RsWhat {
 				// failures only go to sender
-				sendInvalidCmd(c, *resp, req)
+				h.sendInvalidCmd(c, *resp, req.AsSlice())
 			} else {
-				h.broadcast(*resp)
+				broadcasts = append(broadcasts, resp)
 			}
 		}
+		h.broadcastBurst(broadcasts)
+	} else if FORWARDED_REQS[req.Word()] {
+		h.forward(c, req, tag)
+	} else {
+		h.sendInvalidCmd(c, *baps3.NewMessage(baps3.RsWhat).AddArg("Unknown command"), req.AsSlice())
+	}
+}
+
+// Passes a request from a client that got through the middleware (see middleware.go) to the
+// right handler, queueing or refusing it if the connector it needs isn't available.
+func (h *hub) dispatchRequest(data clientAndMessage) {
+	if data.local != nil {
+		h.processLocalRequest(data.c, data.local)
+	} else if conn := h.connectorFor(data.msg.Word()); h.config.Standalone != "" || conn.available() {
+		h.processRequest(data.c, data.msg, data.tag)
+	} else if !conn.up() && conn.dial != nil {
+		h.queueRequest(conn, data)
 	} else {
-		h.cReqCh <- req
+		h.sendUnavailable(data.c, data.tag, data.msg)
 	}
 }
 
@@ -280,89 +573,1203 @@ func (h *hub) processRequest(c *Client, req baps3.Message) {
 
 func (h *hub) handleRsEnd(res baps3.Message) {
 	if h.autoAdvance && h.pl.Advance() { // Selection changed
-		h.cReqCh <- *baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data)
+		h.sendDownstream(*baps3.NewMessage(baps3.RqLoad).AddArg(h.pl.items[h.pl.selection].Data))
 		h.broadcast(*baps3.NewMessage(baps3.RsSelect).AddArg(strconv.Itoa(h.pl.selection)))
 	}
 }
 
-// Processes a response from the downstream service.
-func (h *hub) processResponse(res baps3.Message) {
-	log.Println("New response:", res.String())
+// Remembers res if it is one of the configured cached responses, to send to new clients.
+// Ejecting unloads the file, so forgets everything.
+func (h *hub) cacheResponse(res baps3.Message) {
+	if res.Word() == baps3.RsState {
+		if state, _ := res.Arg(0); state == baps3.StEjected.String() {
+			h.responseCache = make(map[string]baps3.Message)
+			return
+		}
+	}
+	if word := res.Word().String(); containsString(h.config.CachedResponses, word) {
+		h.responseCache[word] = res
+	}
+}
+
+// Gets the cached responses a new client is sent, in the order they're configured, or none if
+// state-replay has been turned off (see set-feature).
+func (h *hub) cachedResponses() (msgs []*baps3.Message) {
+	if !h.featureOn("state-replay") {
+		return
+	}
+	for _, word := range h.config.CachedResponses {
+		if res, ok := h.responseCache[word]; ok {
+			msgs = append(msgs, &res)
+		}
+	}
+	return
+}
+
+// Sends a downstream response to all clients, unless it's one of the suppressed responses.
+// TIME responses only go to clients that want them (see time-updates).
+func (h *hub) broadcastResponse(res baps3.Message) {
+	if containsString(h.config.SuppressedResponses, res.Word().String()) {
+		h.logger.Debug("Suppressed response:", res.String())
+		return
+	}
+	h.accessLog.logResponse(nil, res)
+	packed, ok := h.pack(res)
+	if !ok {
+		return
+	}
+	packed.seq = atomic.AddUint64(&h.counts.broadcast, 1)
+	for c, _ := range h.clients {
+		if res.Word() != baps3.RsTime || c.wantsTime {
+			h.sendPacked(c, packed)
+		}
+	}
+}
+
+// Broadcasts a TIME response, unless one was broadcast less than TimeInterval ago. If so, it's
+// held back, replacing any held back already, until flushTime broadcasts it once the interval is up.
+func (h *hub) throttleTime(res baps3.Message) {
+	if wait := h.config.TimeInterval.Duration - time.Since(h.lastTime); wait > 0 {
+		if h.pendingTime == nil {
+			h.timeFlushCh = time.After(wait)
+		}
+		h.pendingTime = &res
+		return
+	}
+	h.lastTime = time.Now()
+	h.broadcastResponse(res)
+}
+
+// Broadcasts the TIME response throttleTime held back.
+func (h *hub) flushTime() {
+	h.timeFlushCh = nil
+	if h.pendingTime == nil {
+		return
+	}
+	res := *h.pendingTime
+	h.pendingTime = nil
+	h.lastTime = time.Now()
+	h.broadcastResponse(res)
+}
+
+// Forwards a request from c, tagged with tag, to the connector it's routed to or, in standalone
+// mode, sends it straight back to c or everyone, depending on the mode.
+func (h *hub) forward(c *Client, req baps3.Message, tag string) {
+	switch h.config.Standalone {
+	case "echo":
+		h.send(c, req)
+	case "broadcast":
+		h.broadcast(req)
+	default:
+		h.sendDownstreamFor(c, tag, req)
+	}
+}
+
+// Sends a request of listd's own to the connector it's routed to, as sendDownstreamFor.
+func (h *hub) sendDownstream(req baps3.Message) {
+	h.sendDownstreamFor(nil, "", req)
+}
+
+// Sends a request to the connector it's routed to, on behalf of c (nil if it's listd's own
+// request), tagged with tag. If that isn't connected, the request is dropped, as there's nowhere
+// to send it, and c told so. In standalone mode, there never is.
+func (h *hub) sendDownstreamFor(c *Client, tag string, req baps3.Message) {
+	if h.config.Standalone != "" {
+		return
+	}
+	conn := h.connectorFor(req.Word())
+	if !conn.up() || !h.trySend(conn, req) {
+		h.logger.Warn("Dropped request for unavailable", conn, ":", req.String())
+		if c != nil {
+			h.sendUnavailable(c, tag, req)
+		}
+		return
+	}
+	atomic.AddUint64(&h.counts.forwarded, 1)
+	h.latency.sent(req)
+	if h.config.RequestTimeout.Duration > 0 {
+		h.expireRequests()
+		h.tags.sent(c, tag, req)
+	}
+}
+
+// Tells c that req, which it tagged with tag, can't be sent downstream.
+func (h *hub) sendUnavailable(c *Client, tag string, req baps3.Message) {
+	res := baps3.NewMessage(baps3.RsFail).AddArg("Downstream service unavailable")
+	if tag == "" {
+		h.sendInvalidCmd(c, *res, req.AsSlice())
+		return
+	}
+	for _, w := range req.AsSlice() {
+		res.AddArg(w)
+	}
+	h.sendTagged(c, tag, *res)
+}
+
+// Processes a response from conn.
+func (h *hub) processResponse(conn *connector, res baps3.Message) {
+	h.logger.Debug("New response from", conn, ":", res.String())
+	if h.probeReply(conn, res) {
+		return
+	}
+	if word, latency, ok := h.latency.received(res); ok {
+		if slow := h.config.SlowDownstream.Duration; slow > 0 && latency > slow {
+			h.logger.Warn(conn, "took", latency, "to answer", word)
+		}
+	}
+	h.expireRequests()
+	if c, tag, ok := h.tags.received(res); ok {
+		h.sendTagged(c, tag, res)
+		return
+	}
+	if conn != h.downstream {
+		// Only the playout system's responses say anything about the playout state
+		h.broadcastResponse(res)
+		return
+	}
+	h.cacheResponse(res)
 	switch res.Word() {
 	case baps3.RsEnd: // Handle, broadcast and update state
 		h.handleRsEnd(res)
 		fallthrough
 	case baps3.RsTime, baps3.RsState: // Broadcast _AND_ update state
-		h.broadcast(res)
+		if res.Word() == baps3.RsTime {
+			switch {
+			case !h.featureOn("time"):
+				// Dropped, though still kept track of for the state
+			case !h.featureOn("time-throttle"):
+				h.broadcastResponse(res)
+			default:
+				h.throttleTime(res)
+			}
+		} else {
+			h.broadcastResponse(res)
+		}
 		fallthrough
 	case baps3.RsOhai, baps3.RsFeatures: // Just update state
 		if err := h.downstreamState.Update(res); err != nil {
 			log.Fatal("Error updating state: " + err.Error())
 		}
 	default:
-		h.broadcast(res)
+		h.broadcastResponse(res)
+	}
+}
+
+// Packs a response for sending to clients. If it can't be packed, the error is logged and ok is
+// false, and the response shouldn't be sent.
+func (h *hub) pack(res baps3.Message) (packed response, ok bool) {
+	packed, err := packResponse(res)
+	if err != nil {
+		h.logger.Error("Couldn't pack response", res.String(), ":", err.Error())
+		return packed, false
+	}
+	packed.lowPriority = containsString(h.config.LowPriorityResponses, res.Word().String())
+	packed.dedup = containsString(h.config.DedupResponses, res.Word().String())
+	return packed, true
+}
+
+// Packs msgs into a burst, which a client is sent one after the other, but which only takes up one
+// place in its buffer, so a long reply, like the whole playlist, can't fill it up by itself.
+// Any that can't be packed are left out, as with pack.
+func (h *hub) packBurst(msgs []*baps3.Message) (burst response) {
+	for _, msg := range msgs {
+		if packed, ok := h.pack(*msg); ok {
+			burst.burst = append(burst.burst, packed)
+		}
+	}
+	return
+}
+
+// Queues a response for a client that isn't registered, so nothing else has been sent to it, and
+// its resCh has room. Never blocks, so a client that has gone away can't hold up the hub.
+func (h *hub) queue(c *Client, res baps3.Message) {
+	packed, ok := h.pack(res)
+	if !ok {
+		return
+	}
+	select {
+	case c.resCh <- packed:
+		c.queued(packed)
+	default:
+	}
+}
+
+// Sends a response message to a client without blocking, as sendPacked.
+func (h *hub) send(c *Client, res baps3.Message) {
+	if packed, ok := h.pack(res); ok {
+		h.sendPacked(c, packed)
+	}
+}
+
+// Sends an already packed response to a client without blocking, on its lowCh if it's low
+// priority, or its resCh otherwise. If that is full, it isn't keeping up, so the response is
+// dropped rather than holding up everyone else. Once it has dropped more than MaxDropped, it is
+// disconnected. Responses identical to the last the client was sent with a DedupResponses word
+// aren't sent again, but count as queued. Broadcasts start with their sequence numbers for clients
+// that want them (see withSeq). Returns whether the response was queued.
+func (h *hub) sendPacked(c *Client, res response) bool {
+	if _, ok := h.clients[c]; !ok {
+		return false // Already removed, maybe by an earlier send
+	}
+	sent, ok := forClient(c, res)
+	if !ok {
+		return true
+	}
+	ch := c.resCh
+	if res.lowPriority {
+		ch = c.lowCh
+	}
+	select {
+	case ch <- sent:
+		c.queued(res)
+		return true
+	default:
+		atomic.AddUint64(&h.counts.dropped, 1)
+		if c.drop() <= uint64(h.config.MaxDropped) {
+			return false
+		}
+		h.removeClient(c)
+		// Write may be stuck writing, so make sure it gives up
+		c.conn.Close()
+		h.logger.Warn("Disconnected slow client", c)
+		return false
+	}
+}
+
+// Gets what c is sent for res: res itself, or with its sequence number if c wants them (see
+// withSeq). ok is false if c isn't sent anything, as res repeats what it was last sent. The
+// responses in a burst are each dealt with the same way, leaving out any it isn't sent.
+func forClient(c *Client, res response) (sent response, ok bool) {
+	if res.burst == nil {
+		if c.repeats(res) {
+			return res, false
+		}
+		if c.wantsSeq && res.seq != 0 {
+			return withSeq(res), true
+		}
+		return res, true
+	}
+	for _, part := range res.burst {
+		if part, ok := forClient(c, part); ok {
+			sent.burst = append(sent.burst, part)
+		}
 	}
+	return sent, sent.burst != nil
+}
+
+// Starts a broadcast with its sequence number, as '#<seq> ', for clients that turned them on with
+// sequence. Every broadcast gets the next number, counting from 1 when the server starts, so a
+// client seeing a gap knows it missed something (a response dropped as it wasn't keeping up, say)
+// and can ask for a dump to catch up. Broadcasts it doesn't get anyway, like TIMEs with
+// time-updates off or repeats of DedupResponses, leave gaps too. Low priority broadcasts can
+// arrive after later ones, as they wait for the rest (see Client.Write).
+func withSeq(res response) response {
+	prefix := "#" + strconv.FormatUint(res.seq, 10) + " "
+	res.packed = append([]byte(prefix), res.packed...)
+	return res
 }
 
-// Send a response message to all clients.
+// Sends a response to a tagged request to the client that sent it, if it's still connected.
+func (h *hub) sendTagged(c *Client, tag string, res baps3.Message) {
+	h.accessLog.logResponse(c, res)
+	packed, err := packTagged(tag, res)
+	if err != nil {
+		h.logger.Error("Couldn't pack response", res.String(), ":", err.Error())
+		return
+	}
+	h.sendPacked(c, packed)
+}
+
+// Gives up on requests the downstream services haven't acknowledged within RequestTimeout,
+// telling the clients that sent any of them tagged that they timed out.
+func (h *hub) expireRequests() {
+	timeout := h.config.RequestTimeout.Duration
+	for _, r := range h.tags.expire(timeout) {
+		if r.c == nil {
+			h.logger.Warn("No answer to listd's", r.req.Word(), "request within", timeout)
+			continue
+		}
+		h.logger.Warn("No answer to", r.req.Word(), "request from", r.c, "within", timeout)
+		if r.tag != "" {
+			res := baps3.NewMessage(baps3.RsFail).AddArg("Timed out")
+			for _, w := range r.req.AsSlice() {
+				res.AddArg(w)
+			}
+			h.sendTagged(r.c, r.tag, *res)
+		}
+	}
+}
+
+// Send a response message to all clients, packing it only once.
+// Clients are sent it in no particular order, but each client gets every response of the same
+// priority in the order it was broadcast, as only runListener's loop sends responses, and Write
+// sends each of resCh and lowCh in order. Low priority responses can be overtaken by the rest, as
+// Write sends those first. Batching only changes how many go in each write, never their order.
 func (h *hub) broadcast(res baps3.Message) {
+	h.accessLog.logResponse(nil, res)
+	packed, ok := h.pack(res)
+	if !ok {
+		return
+	}
+	packed.seq = atomic.AddUint64(&h.counts.broadcast, 1)
 	for c, _ := range h.clients {
-		c.resCh <- res
+		h.sendPacked(c, packed)
 	}
 }
 
-// Listens for new connections on addr:port and spins up the relevant goroutines.
-func (h *hub) runListener(addr string, port string) {
-	netListener, err := net.Listen("tcp", addr+":"+port)
-	if err != nil {
-		log.Println("Listening error:", err.Error())
+// Sends responses to all clients as one burst (see packBurst), each with its own sequence number,
+// so however long a reply to one request is, like a list of the whole playlist, it can't fill up
+// the buffers of clients that are keeping up. A single response is just broadcast.
+func (h *hub) broadcastBurst(msgs []*baps3.Message) {
+	switch len(msgs) {
+	case 0:
 		return
+	case 1:
+		h.broadcast(*msgs[0])
+		return
+	}
+	for _, msg := range msgs {
+		h.accessLog.logResponse(nil, *msg)
+	}
+	burst := h.packBurst(msgs)
+	for i := range burst.burst {
+		burst.burst[i].seq = atomic.AddUint64(&h.counts.broadcast, 1)
 	}
+	for c, _ := range h.clients {
+		h.sendPacked(c, burst)
+	}
+}
 
-	// Get new connections
-	go func() {
-		for {
-			conn, err := netListener.Accept()
-			if err != nil {
-				log.Println("Error accepting connection:", err.Error())
+// Re-sends every client the current state. That changes nothing for them, but makes their Write
+// notice if they've gone away, so it's never dropped as a repeat (see DedupResponses).
+// Does nothing if heartbeat has been turned off (see set-feature).
+func (h *hub) sendHeartbeat() {
+	if !h.featureOn("heartbeat") {
+		return
+	}
+	packed, ok := h.pack(*baps3.NewMessage(baps3.RsState).AddArg(h.downstreamState.State.String()))
+	if !ok {
+		return
+	}
+	packed.dedup = false
+	for c, _ := range h.clients {
+		h.sendPacked(c, packed)
+	}
+}
+
+// Gets what a client's address is counted under for MaxClientsPerAddr: its IP address, or ""
+// if it doesn't have one, as with Unix socket peers, which aren't counted.
+func clientAddrKey(client *Client) string {
+	if ip := addrIP(client.RemoteAddr()); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Sends a client the reason it was refused, then closes its resCh. That makes Write return once
+// the refusal is sent, which closes the connection and gets Read to route the client to rmCh.
+// The client must not be registered, and so never is; handleRequest drops anything it sends.
+func (h *hub) refuseClient(client *Client, reason string) {
+	client.markRemoved()
+	h.queue(client, *baps3.NewMessage(baps3.RsFail).AddArg(reason))
+	close(client.resCh)
+	h.logger.Warn("Refused connection from", client, ":", reason)
+}
+
+// Registers a new client and sends it the welcome, unless there are already MaxClients clients,
+// or MaxClientsPerAddr from its address, in which case it is refused.
+// Must only be called from within runListener's loop.
+func (h *hub) addClient(client *Client) {
+	if h.isDraining() {
+		h.refuseClient(client, "Draining")
+		return
+	}
+	if len(h.clients) >= h.config.MaxClients {
+		h.refuseClient(client, "Too many clients")
+		return
+	}
+	key := clientAddrKey(client)
+	if until, ok := h.lockouts[key]; ok {
+		if time.Now().Before(until) {
+			h.refuseClient(client, "Locked out")
+			return
+		}
+		delete(h.lockouts, key)
+	}
+	if key != "" && h.config.MaxClientsPerAddr > 0 && h.clientsPerAddr[key] >= h.config.MaxClientsPerAddr {
+		h.refuseClient(client, "Too many clients from your address")
+		return
+	}
+
+	h.clients[client] = true
+	atomic.StoreInt64(&h.numClients, int64(len(h.clients)))
+	atomic.AddUint64(&h.counts.accepted, 1)
+	if key != "" {
+		h.clientsPerAddr[key]++
+	}
+	// However long, the welcome is one burst, so fits in the client's empty resCh; the hub never
+	// waits for a client to take it, as one that goes away part way through never would
+	welcome := append([]*baps3.Message{h.makeRsOhai(), h.makeRsFeatures(client)}, h.makeDumpResponses()...)
+	h.sendPacked(client, h.packBurst(append(welcome, h.cachedResponses()...)))
+	h.logger.Info("New connection from", client)
+	h.publish(EventConnect, client, "")
+}
+
+// Unregisters a client, which ends its Write goroutine and so closes its connection.
+// Does nothing if the client isn't registered, as when it has been removed already, so its resCh
+// is only ever closed once. Must only be called from within runListener's loop.
+func (h *hub) removeClient(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	client.markRemoved()
+	close(client.resCh)
+	delete(h.clients, client)
+	if key := clientAddrKey(client); key != "" {
+		if h.clientsPerAddr[key]--; h.clientsPerAddr[key] <= 0 {
+			delete(h.clientsPerAddr, key)
+		}
+	}
+	atomic.StoreInt64(&h.numClients, int64(len(h.clients)))
+	requests, responses := client.Counts()
+	h.logger.Info("Client", client, "sent", requests, "requests and was sent", responses, "responses in", client.age())
+	if dropped := client.Dropped(); dropped > 0 {
+		h.logger.Info("Dropped", dropped, "responses to", client)
+	}
+	if shaped := client.ShapedBytes(); shaped > 0 {
+		h.logger.Info("Dropped", shaped, "bytes of responses to", client, "over its output rate")
+	}
+	h.publish(EventDisconnect, client, "")
+}
+
+// Registers the clients waiting on addCh, if c isn't registered. With a ChannelBuffer, a client's
+// first requests, or its leaving, can be picked up before it is, though it was sent to addCh first.
+func (h *hub) catchUpAdds(c *Client) {
+	if _, ok := h.clients[c]; ok {
+		return
+	}
+	for {
+		select {
+		case client := <-h.addCh:
+			h.addClient(client)
+		default:
+			return
+		}
+	}
+}
+
+// Unregisters a client its Read or Write has given up on. Both may send the same client to rmCh,
+// and the hub may have removed it already, closing its resCh, so clients that aren't registered
+// are ignored. So are refused clients, which never were.
+func (h *hub) clientGone(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	h.removeClient(client)
+	h.logger.Info("Closed connection from", client, "after", client.age())
+}
+
+// Starts or stops draining. While draining, new clients are refused, so they go to another
+// server, but clients already connected are served as normal, until they leave. That lets a
+// server be taken out of service without cutting anyone off. Safe to call from any goroutine.
+func (h *hub) setDraining(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&h.draining, v) != v {
+		if on {
+			h.logger.Info("Draining, so refusing new clients")
+		} else {
+			h.logger.Info("Stopped draining, so accepting new clients again")
+		}
+	}
+}
+
+// Checks whether new clients are being refused. Safe to call from any goroutine.
+func (h *hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Gets how many clients are currently registered. Safe to call from any goroutine.
+func (h *hub) ClientCount() int {
+	return int(atomic.LoadInt64(&h.numClients))
+}
+
+// Disconnects all clients that have neither sent nor received anything for idleTimeout.
+func (h *hub) sweepIdleClients(idleTimeout time.Duration) {
+	for c, _ := range h.clients {
+		if idle := c.idleFor(); idle >= idleTimeout {
+			h.removeClient(c)
+			h.logger.Info("Closed idle connection from", c, "after", idle)
+		}
+	}
+}
+
+// Gets how often to sweep for idle clients and lockouts that have run out: often enough for both
+// IdleTimeout and AuthLockout, or 0 if neither is on, so there's nothing to sweep.
+func sweepInterval(cfg *Config) time.Duration {
+	interval := cfg.IdleTimeout.Duration / 2
+	if lockout := cfg.AuthLockout.Duration; lockout > 0 && (interval == 0 || lockout < interval) {
+		interval = lockout
+	}
+	return interval
+}
+
+// Loads the certificate/key pair at certFile and keyFile into a TLS config for the listener.
+// If clientCAFile isn't empty, clients must present a certificate signed by one of the CAs in it.
+func loadTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates in client CA file %s", clientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// Longest a client can take over the TLS handshake before it is disconnected.
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Does the TLS handshake on conn, so its client certificate (if any) has been verified.
+// If the certificate is for a common name, that's who the client is authenticated as.
+func (h *hub) handshake(client *Client, conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 && certs[0].Subject.CommonName != "" {
+		// Not registered yet, so the hub isn't looking at user
+		client.user = certs[0].Subject.CommonName
+		h.logger.Info("Authenticated", client, "as", client.user, "by certificate")
+	}
+	return nil
+}
+
+// Works out which network to listen on for addr and port.
+// Addresses that are paths, or start with unix://, are Unix domain sockets (and ignore port);
+// anything else is a TCP host.
+func listenAddr(addr string, port string) (network string, address string) {
+	if strings.HasPrefix(addr, "unix://") {
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, ".") {
+		return "unix", addr
+	}
+	return "tcp", net.JoinHostPort(addr, port)
+}
+
+// The first file descriptor systemd passes, as in sd_listen_fds(3).
+const SD_LISTEN_FDS_START = 3
+
+// Gets the listening socket systemd passed listd, if it was started by socket activation, as
+// described in sd_listen_fds(3). activated is false if it wasn't, in which case listd should
+// listen for itself. Only the first socket is used. The environment variables saying what was
+// passed are unset, so they aren't passed on to anything listd starts.
+func systemdListener(getenv func(string) string) (l net.Listener, activated bool, err error) {
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(SD_LISTEN_FDS_START, "systemd socket")
+	defer f.Close() // FileListener has its own copy
+	if l, err = net.FileListener(f); err != nil {
+		return nil, false, fmt.Errorf("Can't use the socket passed by systemd: %s", err.Error())
+	}
+	return l, true, nil
+}
+
+// Longest wait before accepting again after a temporary error.
+const MAX_ACCEPT_BACKOFF = time.Second
+
+// Listens for new connections on the config's address and port and spins up the relevant goroutines.
+// If systemd passed a listening socket (see systemdListener), that's used instead.
+// If the address is a Unix socket path (see listenAddr), the socket is removed on quit.
+// Connections are encrypted with tlsConfig, unless it is nil.
+// At most MaxClients clients are registered at once; any more get refused.
+// Clients that send nothing for ReadTimeout, or take longer than WriteTimeout to accept a
+// response, are disconnected, as are clients neither sending nor receiving anything for
+// IdleTimeout; any of these can be 0 to disable it.
+// Every HeartbeatInterval (if not 0), all clients are sent the current state to check they're still there.
+// Runs until ctx is cancelled, returning nil, or until listening fails, returning why (see serve).
+func (h *hub) runListener(ctx context.Context, cfg *Config, tlsConfig *tls.Config) error {
+	h.config = cfg
+	h.sharedConfig.Store(cfg)
+	h.started = time.Now()
+
+	network, address := listenAddr(cfg.Addr, cfg.Port)
+	netListener, activated, err := systemdListener(os.Getenv)
+	if err != nil {
+		return err
+	}
+	if activated {
+		h.logger.Info("Using the socket passed by systemd, instead of", address)
+	} else if netListener, err = net.Listen(network, address); err != nil {
+		return err
+	}
+	// Connections are wrapped with TLS as they're handled, after any PROXY header
+	h.tlsConfig = tlsConfig
+	h.logger.Info("Listening on", netListener.Addr(), "TLS enabled:", tlsConfig != nil)
+	h.addr = netListener.Addr()
+	close(h.listening)
+
+	err = h.serve(ctx, netListener)
+	// A socket systemd passed isn't ours to remove
+	if network == "unix" && !activated {
+		if err := os.Remove(address); err != nil {
+			h.logger.Warn("Error removing socket:", err.Error())
+		}
+	}
+	return err
+}
+
+// Accepts connections from l and serves each with handleNewConnection, until ctx is cancelled.
+// Connections beyond MaxConnections are closed straight away.
+// Temporary errors, like running out of file descriptors, are retried after a backoff; any other
+// error means l won't accept anything again, so is sent down errCh and ends the loop.
+func (h *hub) acceptConnections(ctx context.Context, l net.Listener, errCh chan<- error) {
+	atomic.StoreInt32(&h.accepting, 1)
+	defer atomic.StoreInt32(&h.accepting, 0)
+	var backoff time.Duration
+
+	// Holds a token for each connection being handled, if MaxConnections limits them, and
+	// whether it was full last time a connection came in
+	var handlers chan struct{}
+	var full bool
+	if max := h.currentConfig().MaxConnections; max > 0 {
+		handlers = make(chan struct{}, max)
+	}
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			// The listener was closed on purpose, so there'll be nothing more to accept
+			return
+		}
+		if err != nil {
+			// Errors like running out of file descriptors tend to repeat, so back off
+			// rather than spinning, as net/http does
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > MAX_ACCEPT_BACKOFF {
+					backoff = MAX_ACCEPT_BACKOFF
+				}
+				h.logger.Warn("Error accepting connection:", err.Error(), "; retrying in", backoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+				}
 				continue
 			}
+			errCh <- err
+			return
+		}
+		backoff = 0
+
+		if handlers != nil {
+			select {
+			case handlers <- struct{}{}:
+				full = false
+			default:
+				// Only logged as the limit is hit, not for every connection in a flood
+				if !full {
+					h.logger.Warn("Refusing connections, as", cap(handlers), "are already being handled")
+					full = true
+				}
+				conn.Close()
+				continue
+			}
+		}
+		h.connWg.Add(1)
+		go func() {
+			defer h.connWg.Done()
+			if handlers != nil {
+				defer func() { <-handlers }()
+			}
+			h.handleNewConnection(ctx, conn)
+		}()
+	}
+}
+
+// Makes a channel that a new ticker sends down every d, adding the ticker to tickers so it can be
+// stopped. If d is 0, there's no ticker, and the channel is nil.
+func newTickCh(d time.Duration, tickers *[]*time.Ticker) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTicker(d)
+	*tickers = append(*tickers, t)
+	return t.C
+}
 
-			go h.handleNewConnection(conn)
+// Serves clients connecting through l, as described for runListener.
+// If l is nil, nothing is accepted, and clients only come from serveClient.
+// Cancelling ctx closes l, every client connection and the downstream connection, then returns
+// nil once every goroutine serving them has finished. If l fails first, everything is closed
+// the same way, and the failure is returned.
+func (h *hub) serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Sweeping idle clients and lockouts, heartbeats, health checks and expiring requests, remade whenever the config is reloaded.
+	// A nil channel never fires, so nothing is done for intervals of 0.
+	var tickers []*time.Ticker
+	var sweepCh, heartbeatCh, healthCh, expireCh, statsCh <-chan time.Time
+	startTickers := func() {
+		for _, t := range tickers {
+			t.Stop()
+		}
+		tickers = nil
+		sweepCh = newTickCh(sweepInterval(h.config), &tickers)
+		heartbeatCh = newTickCh(h.config.HeartbeatInterval.Duration, &tickers)
+		// Ticking more often than the interval means quiet services are probed soon after it's up
+		healthCh = newTickCh(h.config.HealthInterval.Duration/2, &tickers)
+		expireCh = newTickCh(h.config.RequestTimeout.Duration/2, &tickers)
+		statsCh = newTickCh(h.config.StatsInterval.Duration, &tickers)
+	}
+	startTickers()
+	defer func() {
+		for _, t := range tickers {
+			t.Stop()
 		}
 	}()
 
+	// Get new connections
+	var acceptErr error
+	acceptErrCh := make(chan error, 1)
+	if l != nil {
+		h.connWg.Add(1)
+		go func() {
+			defer h.connWg.Done()
+			h.acceptConnections(ctx, l, acceptErrCh)
+		}()
+	}
+	for _, conn := range h.connectors {
+		if conn.up() {
+			h.heardFrom(conn)
+			h.startForwarding(ctx, conn, conn.resCh)
+		}
+	}
+
 	for {
+		h.storeReady()
 		select {
-		case msg := <-h.cResCh:
-			h.processResponse(msg)
+		case res := <-h.downResCh:
+			if res.closed {
+				h.handleDownstreamClosed(ctx, res.conn)
+				continue
+			}
+			h.heardFrom(res.conn)
+			h.processResponse(res.conn, res.msg)
+		case dc := <-h.connCh:
+			dc.conn.reqCh, dc.conn.resCh = dc.reqCh, dc.resCh
+			h.heardFrom(dc.conn)
+			h.startForwarding(ctx, dc.conn, dc.resCh)
+			h.logger.Info("Reconnected to", dc.conn)
+			h.resync(dc.conn)
+			h.flushQueued(dc.conn)
 		case data := <-h.reqCh:
-			h.processRequest(data.c, data.msg)
+			h.catchUpAdds(data.c)
+			h.handleRequest(data)
 		case client := <-h.addCh:
-			h.clients[client] = true
-			client.resCh <- *h.makeRsOhai()
-			client.resCh <- *h.makeRsFeatures()
-			for _, msg := range h.makeDumpResponses() {
-				client.resCh <- *msg
-			}
-			log.Println("New connection from", client.conn.RemoteAddr())
+			h.addClient(client)
 		case client := <-h.rmCh:
-			close(client.resCh)
-			delete(h.clients, client)
-			log.Println("Closed connection from", client.conn.RemoteAddr())
-		case <-h.Quit:
-			log.Println("Closing all connections")
-			for c, _ := range h.clients {
-				close(c.resCh)
-				delete(h.clients, c)
+			h.catchUpAdds(client)
+			h.clientGone(client)
+		case <-expireCh:
+			h.expireRequests()
+		case <-healthCh:
+			h.checkConnectors(h.config.HealthInterval.Duration, h.config.HealthTimeout.Duration)
+		case <-sweepCh:
+			if idleTimeout := h.config.IdleTimeout.Duration; idleTimeout > 0 {
+				h.sweepIdleClients(idleTimeout)
 			}
-			//			h.Quit <- true
+			h.sweepLockouts()
+		case cfg := <-h.reloadCh:
+			h.reloadConfig(cfg)
+			startTickers()
+		case <-h.timeFlushCh:
+			h.flushTime()
+		case <-heartbeatCh:
+			h.sendHeartbeat()
+		case <-statsCh:
+			h.logStats()
+		case acceptErr = <-acceptErrCh:
+			h.logger.Error("Error accepting connection, so shutting down:", acceptErr.Error())
+			// Goroutines serving clients all stop on ctx, so cancel it as for a normal shutdown
+			cancel()
+		case <-ctx.Done():
+			h.logger.Info("Closing all connections")
+			if l != nil {
+				l.Close()
+			}
+			closing := h.closeClients()
+			h.closeConnectors()
+			h.waitConns(closing)
+			return acceptErr
+		}
+	}
+}
+
+// How long clients are given to be sent their goodbye on shutdown, before their connections
+// are closed anyway.
+const SHUTDOWN_FLUSH_TIMEOUT = time.Second
+
+// Tells every client the server is shutting down, then removes it. Its Write sends the goodbye
+// and anything else still queued, then closes the connection, which gets Read to return.
+// Clients with no room for the goodbye may be removed as slow by sendPacked instead.
+// Returns the clients removed.
+func (h *hub) closeClients() (closing []*Client) {
+	packed, _ := h.pack(*baps3.NewMessage(baps3.RsFail).AddArg("Shutting down"))
+	for c, _ := range h.clients {
+		h.sendPacked(c, packed)
+		if _, ok := h.clients[c]; ok {
+			h.removeClient(c)
+		}
+		closing = append(closing, c)
+	}
+	return
+}
+
+// Waits for every goroutine serving clients or connectors to return. Any of closing still being
+// written to after SHUTDOWN_FLUSH_TIMEOUT have their connections closed, to make sure they do.
+func (h *hub) waitConns(closing []*Client) {
+	done := make(chan struct{})
+	go func() {
+		h.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_FLUSH_TIMEOUT):
+		h.logger.Warn("Gave up sending goodbyes to clients")
+		for _, c := range closing {
+			c.conn.Close()
 		}
+		<-done
 	}
 }
 
-// Sets up the connector channels for the hub object.
+// A downstream service listd forwards requests to, such as the playout system.
+// Only used from within runListener's loop, apart from dial.
+type connector struct {
+	name string
+	// For communication with the service. Both are nil while it's disconnected.
+	reqCh chan<- baps3.Message
+	resCh <-chan baps3.Message
+	// Reconnects to the service when it drops, if not nil.
+	dial dialFunc
+
+	// Requests held while reconnecting, oldest first, to be processed once reconnected.
+	queued []clientAndMessage
+
+	// For health checks: when the service was last heard from, when the probe still waiting for
+	// an answer was sent (zero if there isn't one), and whether it failed to answer in time.
+	// probing is when the probe whose reply is still coming was sent (zero if there isn't one).
+	lastHeard time.Time
+	probeSent time.Time
+	probing   time.Time
+	unhealthy bool
+}
+
+// Names the connector, for logging.
+func (c *connector) String() string {
+	return "connector " + c.name
+}
+
+// Checks whether the service is connected, so requests can be sent to it.
+func (c *connector) up() bool {
+	return c.reqCh != nil
+}
+
+// Checks whether the service is connected and answering, so requests sent to it should be acted on.
+func (c *connector) available() bool {
+	return c.up() && !c.unhealthy
+}
+
+// Describes the connector's health, for connector-status.
+func (c *connector) status() string {
+	switch {
+	case !c.up():
+		return "disconnected"
+	case c.unhealthy:
+		return "unhealthy"
+	default:
+		return "healthy"
+	}
+}
+
+// A response from a connector, or (if closed is true) news that its connection has gone.
+type connectorResponse struct {
+	conn   *connector
+	msg    baps3.Message
+	closed bool
+}
+
+// Sets up the channels for the hub object's connector to the playout system.
 func (h *hub) setConnector(cReqCh chan<- baps3.Message, cResCh <-chan baps3.Message) {
-	h.cReqCh = cReqCh
-	h.cResCh = cResCh
+	h.downstream.reqCh = cReqCh
+	h.downstream.resCh = cResCh
+}
+
+// Adds a connector called name, which requests with the given words are sent to instead of the
+// playout system. It isn't connected until ListenAndServe dials it with dial.
+func (h *hub) addConnector(name string, dial dialFunc, words []baps3.MessageWord) {
+	conn := &connector{name: name, dial: dial}
+	h.connectors = append(h.connectors, conn)
+	for _, word := range words {
+		h.routes[word] = conn
+	}
+}
+
+// Disconnects every connector that's connected, by closing its reqCh.
+func (h *hub) closeConnectors() {
+	for _, conn := range h.connectors {
+		if conn.up() {
+			close(conn.reqCh)
+			conn.reqCh, conn.resCh = nil, nil
+		}
+	}
+}
+
+// Records that conn's service has just been heard from, so is healthy.
+func (h *hub) heardFrom(conn *connector) {
+	conn.lastHeard = time.Now()
+	conn.probeSent = time.Time{}
+	if conn.unhealthy {
+		conn.unhealthy = false
+		h.logger.Info(conn, "is healthy again")
+	}
+}
+
+// Probes every connected service that has been quiet for interval, by sending it a dump, which
+// shouldn't change anything, and whose reply isn't passed on (see probeReply). Services that
+// haven't answered a probe within timeout are marked unhealthy, and probed again. Anything they
+// send counts as an answer.
+func (h *hub) checkConnectors(interval time.Duration, timeout time.Duration) {
+	for _, conn := range h.connectors {
+		if !conn.up() {
+			continue
+		}
+		if !conn.probeSent.IsZero() {
+			if time.Since(conn.probeSent) < timeout {
+				continue
+			}
+			if !conn.unhealthy {
+				conn.unhealthy = true
+				h.logger.Warn(conn, "didn't answer for", timeout, "so is unhealthy")
+			}
+		} else if time.Since(conn.lastHeard) < interval {
+			continue
+		}
+		conn.probeSent = time.Now()
+		if h.trySend(conn, *baps3.NewMessage(baps3.RqDump)) {
+			conn.probing = conn.probeSent
+		}
+	}
+}
+
+// Checks whether res is part of conn's reply to a health probe. That only shows the service is
+// still answering, and says nothing new, so isn't acted on, and clients aren't sent it again.
+// The reply ends with the probe's acknowledgement, or, for services that don't send one, once
+// HealthTimeout is up, so nothing after it is mistaken for part of it.
+func (h *hub) probeReply(conn *connector, res baps3.Message) bool {
+	if conn.probing.IsZero() {
+		return false
+	}
+	if time.Since(conn.probing) > h.config.HealthTimeout.Duration {
+		conn.probing = time.Time{}
+		return false
+	}
+	if word, ok := answeredWord(res); ok && word == baps3.RqDump {
+		conn.probing = time.Time{}
+	}
+	return true
+}
+
+// Holds a request for conn, which is reconnecting, until it's back, as long as no more than
+// ReconnectQueue are held already. Otherwise tells the client it can't be sent.
+func (h *hub) queueRequest(conn *connector, data clientAndMessage) {
+	if len(conn.queued) >= h.config.ReconnectQueue {
+		h.sendUnavailable(data.c, data.tag, data.msg)
+		return
+	}
+	h.logger.Debug("Holding request from", data.c, "until", conn, "reconnects:", data.msg.String())
+	conn.queued = append(conn.queued, data)
+}
+
+// Asks conn, which has just reconnected, for a dump of its state. What it sends back is broadcast
+// and cached as usual, so every client catches up with whatever changed while it was away.
+// Only the playout system's state is kept, so other connectors aren't asked.
+func (h *hub) resync(conn *connector) {
+	if conn != h.downstream {
+		return
+	}
+	h.logger.Debug("Resyncing with", conn)
+	h.trySend(conn, *baps3.NewMessage(baps3.RqDump))
+}
+
+// Processes the requests held while conn was reconnecting, in the order they came in, except
+// those from clients that have since gone.
+func (h *hub) flushQueued(conn *connector) {
+	queued := conn.queued
+	conn.queued = nil
+	if len(queued) > 0 {
+		h.logger.Info("Sending", len(queued), "requests held while", conn, "was reconnecting")
+	}
+	for _, data := range queued {
+		if _, ok := h.clients[data.c]; ok {
+			h.processRequest(data.c, data.msg, data.tag)
+		}
+	}
+}
+
+// Longest a connector can take to accept a request before it's given up on, so a service that
+// has stopped taking requests holds up the hub no longer than this.
+const CONNECTOR_SEND_TIMEOUT = 500 * time.Millisecond
+
+// Sends req to conn, which must be connected, unless it doesn't take it within
+// CONNECTOR_SEND_TIMEOUT. If it doesn't, it's marked unhealthy, so requests for it fail straight
+// away until it's heard from, and false is returned.
+func (h *hub) trySend(conn *connector, req baps3.Message) bool {
+	t := time.NewTimer(CONNECTOR_SEND_TIMEOUT)
+	defer t.Stop()
+	select {
+	case conn.reqCh <- req:
+		return true
+	case <-t.C:
+		if !conn.unhealthy {
+			conn.unhealthy = true
+			h.logger.Warn(conn, "isn't taking requests, so is unhealthy")
+		}
+		return false
+	}
+}
+
+// Gets the connector requests with word are sent to.
+func (h *hub) connectorFor(word baps3.MessageWord) *connector {
+	if conn, ok := h.routes[word]; ok {
+		return conn
+	}
+	return h.downstream
+}
+
+// Starts passing responses from resCh, conn's current connection, to runListener's loop.
+func (h *hub) startForwarding(ctx context.Context, conn *connector, resCh <-chan baps3.Message) {
+	h.connWg.Add(1)
+	go func() {
+		defer h.connWg.Done()
+		h.forwardResponses(ctx, conn, resCh)
+	}()
+}
+
+// Passes responses from resCh to downResCh, tagged with conn, so runListener's loop can wait on
+// every connector at once. Once resCh is closed, says so and returns. Gives up once ctx is cancelled.
+func (h *hub) forwardResponses(ctx context.Context, conn *connector, resCh <-chan baps3.Message) {
+	for {
+		var res connectorResponse
+		select {
+		case msg, more := <-resCh:
+			res = connectorResponse{conn: conn, msg: msg, closed: !more}
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case h.downResCh <- res:
+		case <-ctx.Done():
+			return
+		}
+		if res.closed {
+			return
+		}
+	}
+}
+
+// Connects to a downstream service, returning channels for talking to it as setConnector takes.
+type dialFunc func() (cReqCh chan<- baps3.Message, cResCh <-chan baps3.Message, err error)
+
+// A new connection for conn, as made by its dialFunc.
+type downstreamConn struct {
+	conn  *connector
+	reqCh chan<- baps3.Message
+	resCh <-chan baps3.Message
+}
+
+// Longest wait between attempts to reconnect to a downstream service.
+const MAX_RECONNECT_BACKOFF = 30 * time.Second
+
+// Handles conn's service going away, which closes its resCh.
+// Clients stay connected, and requests for it fail until reconnect gets through.
+func (h *hub) handleDownstreamClosed(ctx context.Context, conn *connector) {
+	h.logger.Error("Lost connection to", conn)
+	close(conn.reqCh)
+	conn.reqCh, conn.resCh = nil, nil
+	// Nothing more of a probe's reply will come, and a reconnect's resync must get through
+	conn.probing = time.Time{}
+	if conn == h.downstream {
+		// Whatever comes back may have nothing loaded, and a held back TIME would be out of date,
+		// so clients aren't sent either; resync fills them in again once it's back
+		h.responseCache = make(map[string]baps3.Message)
+		h.pendingTime, h.timeFlushCh = nil, nil
+	}
+	if conn.dial != nil {
+		h.connWg.Add(1)
+		go func() {
+			defer h.connWg.Done()
+			h.reconnect(ctx, conn)
+		}()
+	}
+}
+
+// Dials conn's service until it succeeds, backing off exponentially between attempts,
+// then hands the new connection to runListener's loop. Gives up once ctx is cancelled,
+// without dialling again.
+func (h *hub) reconnect(ctx context.Context, conn *connector) {
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		// Both may have been ready, and select picks either
+		if ctx.Err() != nil {
+			return
+		}
+		reqCh, resCh, err := conn.dial()
+		if err == nil {
+			select {
+			case h.connCh <- downstreamConn{conn, reqCh, resCh}:
+			case <-ctx.Done():
+				close(reqCh) // Nobody else will, now
+			}
+			return
+		}
+		h.logger.Warn("Error reconnecting to", conn, ":", err.Error())
+		if backoff *= 2; backoff > MAX_RECONNECT_BACKOFF {
+			backoff = MAX_RECONNECT_BACKOFF
+		}
+	}
 }
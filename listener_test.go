@@ -0,0 +1,1306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Creates a hub with dummy connector channels, as main would.
+func makeTestHub() *hub {
+	h := initHub(defaultConfig(), newStdLogger(levelInfo), nil)
+	h.setConnector(make(chan baps3.Message), make(chan baps3.Message))
+	return h
+}
+
+// Creates a client registered with h, over an in-memory connection.
+// Returns the other end of the connection, which the caller should close.
+func makeTestClient(h *hub) (*Client, net.Conn) {
+	conn, other := net.Pipe()
+	c := &Client{
+		id:        nextClientID(),
+		connected: time.Now(),
+		conn:      conn,
+		logger:    h.logger,
+		resCh:     make(chan response, h.config.ResponseBuffer),
+		lowCh:     make(chan response, h.config.ResponseBuffer),
+		tok:       baps3.NewTokeniser(),
+		wantsTime: true,
+	}
+	h.clients[c] = true
+	return c, other
+}
+
+// A scripted stand-in for a downstream service. Its dial is a dialFunc, so it can be given to
+// InitServer or WithConnector. Every request it's sent is recorded, then answered with the
+// responses scripted for its word, if any.
+type mockConnector struct {
+	mu       sync.Mutex
+	script   map[baps3.MessageWord][]baps3.Message
+	received []baps3.Message
+	// Gets every request as it comes in, for next.
+	gotCh chan baps3.Message
+}
+
+func newMockConnector() *mockConnector {
+	return &mockConnector{
+		script: make(map[baps3.MessageWord][]baps3.Message),
+		gotCh:  make(chan baps3.Message, 100),
+	}
+}
+
+// Scripts the responses to requests with word, replacing any scripted before.
+func (m *mockConnector) answer(word baps3.MessageWord, responses ...*baps3.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.script[word] = nil
+	for _, res := range responses {
+		m.script[word] = append(m.script[word], *res)
+	}
+}
+
+// Connects to the mock, as a dialFunc. The connection closes once its cReqCh is closed.
+func (m *mockConnector) dial() (chan<- baps3.Message, <-chan baps3.Message, error) {
+	reqCh, resCh := make(chan baps3.Message), make(chan baps3.Message, 100)
+	go func() {
+		defer close(resCh)
+		for req := range reqCh {
+			m.mu.Lock()
+			m.received = append(m.received, req)
+			responses := m.script[req.Word()]
+			m.mu.Unlock()
+			m.gotCh <- req
+			for _, res := range responses {
+				resCh <- res
+			}
+		}
+	}()
+	return reqCh, resCh, nil
+}
+
+// Waits for the next request the mock is sent, failing t if none comes within a second.
+func (m *mockConnector) next(t *testing.T) baps3.Message {
+	select {
+	case req := <-m.gotCh:
+		return req
+	case <-time.After(time.Second):
+		t.Fatalf("mockConnector: no request received")
+		return baps3.Message{}
+	}
+}
+
+// Gets every request the mock has been sent so far, oldest first.
+func (m *mockConnector) requests() []baps3.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]baps3.Message(nil), m.received...)
+}
+
+// Dials addr, retrying until the listener comes up.
+func dialTestListener(t *testing.T, addr string) net.Conn {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("dialTestListener: could not connect to %s", addr)
+	return nil
+}
+
+func TestListenIPv6(t *testing.T) {
+	// Not every test machine has IPv6 loopback
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("TestListenIPv6: no IPv6 loopback available")
+	} else {
+		l.Close()
+	}
+
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Addr, cfg.Port = "::1", "13511"
+	go h.runListener(context.Background(), cfg, nil)
+
+	conn := dialTestListener(t, "[::1]:13511")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestListenIPv6: returned err on read (%s)", err.Error())
+	}
+	if !strings.HasPrefix(line, "OHAI") {
+		t.Errorf("TestListenIPv6: got %q, want OHAI", line)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	const maxClients = 3
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Port, cfg.MaxClients = "13510", maxClients
+	go h.runListener(context.Background(), cfg, nil)
+
+	for i := 0; i <= maxClients; i++ {
+		conn := dialTestListener(t, "127.0.0.1:13510")
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("TestMaxClients: connection %d returned err on read (%s)", i, err.Error())
+		}
+		refused := strings.HasPrefix(line, "FAIL") && strings.Contains(line, "Too many clients")
+		if i < maxClients && refused {
+			t.Errorf("TestMaxClients: connection %d refused when under limit", i)
+		} else if i == maxClients && !refused {
+			t.Errorf("TestMaxClients: connection %d got %q, want refusal", i, line)
+		}
+	}
+}
+
+// A refused client's Read is already running, but nothing it sends after the refusal is acted on.
+func TestRefusedClientIgnored(t *testing.T) {
+	h := makeTestHub()
+	h.config.MaxClients = 1
+	mock := newMockConnector()
+	mock.answer(baps3.RqStop, baps3.NewMessage(baps3.RsState).AddArg("Stopped"))
+	cReqCh, cResCh, _ := mock.dial()
+	h.setConnector(cReqCh, cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+	readWelcome(t, reader)
+
+	refusedConn, refusedOther := net.Pipe()
+	defer refusedOther.Close()
+	go h.serveClient(ctx, h.newClient(refusedConn))
+	refusedOther.SetDeadline(time.Now().Add(time.Second))
+	go refusedOther.Write([]byte(strings.Repeat("play\n", 20)))
+	if out, _ := ioutil.ReadAll(refusedOther); !strings.Contains(string(out), "Too many clients") {
+		t.Fatalf("TestRefusedClientIgnored: got %q, want refusal", out)
+	}
+
+	go other.Write([]byte("stop\n"))
+	if req := mock.next(t); req.Word() != baps3.RqStop {
+		t.Errorf("TestRefusedClientIgnored: connector got %q from refused client", req.String())
+	}
+	// Anything still on the way from the refused client would have come by now
+	time.Sleep(50 * time.Millisecond)
+	for _, req := range mock.requests() {
+		if req.Word() != baps3.RqStop {
+			t.Errorf("TestRefusedClientIgnored: connector got %q from refused client", req.String())
+		}
+	}
+}
+
+// Connections beyond MaxConnections are closed without a word, until one of the others leaves.
+func TestMaxConnections(t *testing.T) {
+	const maxConns = 2
+	cfg := defaultConfig()
+	cfg.Port, cfg.MaxConnections = "0", maxConns
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+	addr := s.Addr()
+
+	// Gets the first line the server sends a new connection, or "" if it closes it first.
+	dial := func() (net.Conn, string) {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("TestMaxConnections: returned err dialling %s (%s)", addr, err.Error())
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, line
+	}
+
+	var conns []net.Conn
+	for i := 0; i < maxConns; i++ {
+		conn, line := dial()
+		defer conn.Close()
+		if !strings.HasPrefix(line, "OHAI") {
+			t.Fatalf("TestMaxConnections: connection %d got %q, want an OHAI", i, line)
+		}
+		conns = append(conns, conn)
+	}
+	conn, line := dial()
+	conn.Close()
+	if line != "" {
+		t.Errorf("TestMaxConnections: connection over the limit got %q, want it closed", line)
+	}
+
+	conns[0].Close()
+	for i := 0; ; i++ {
+		conn, line := dial()
+		conn.Close()
+		if strings.HasPrefix(line, "OHAI") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("TestMaxConnections: still refused after a connection left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Only the hub's loop may touch the clients map. Run under -race, this checks nothing else does
+// while lots of clients connect, send requests that get broadcast, and disconnect at once.
+func TestConcurrentClients(t *testing.T) {
+	const numClients = 50
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Port = "13512"
+	// Every client gets every other client's broadcasts, which can all come at once
+	cfg.ResponseBuffer = 4 * numClients
+	go h.runListener(context.Background(), cfg, nil)
+	dialTestListener(t, "127.0.0.1:13512").Close()
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				h.ClientCount()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := dialTestListener(t, "127.0.0.1:13512")
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			conn.Write([]byte("autoadvance on\nlist\nlist-clients\n"))
+			reader := bufio.NewReader(conn)
+			for j := 0; j < 5; j++ {
+				if _, err := reader.ReadString('\n'); err != nil {
+					t.Errorf("TestConcurrentClients: returned err on read (%s)", err.Error())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	for i := 0; h.ClientCount() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("TestConcurrentClients: %d clients still registered, want 0", h.ClientCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelListener(t *testing.T) {
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Port = "13513"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.runListener(ctx, cfg, nil) }()
+
+	conn := dialTestListener(t, "127.0.0.1:13513")
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("TestCancelListener: returned err on read (%s)", err.Error())
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("TestCancelListener: runListener returned err (%s), want nil", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestCancelListener: runListener didn't return after cancel")
+	}
+
+	// Whatever's left of the welcome, then the connection closing
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Errorf("TestCancelListener: connection not closed (%s)", err.Error())
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:13513"); err == nil {
+		t.Errorf("TestCancelListener: listener still accepting after cancel")
+	}
+}
+
+func TestCancelNoLeaks(t *testing.T) {
+	const numClients = 10
+	before := runtime.NumGoroutine()
+
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Port = "13514"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.runListener(ctx, cfg, nil) }()
+
+	// Connected clients that never send anything leave their Read goroutines blocked
+	for i := 0; i < numClients; i++ {
+		conn := dialTestListener(t, "127.0.0.1:13514")
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("TestCancelNoLeaks: returned err on read (%s)", err.Error())
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("TestCancelNoLeaks: runListener didn't return after cancel")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("TestCancelNoLeaks: %d goroutines after cancel, want at most %d", after, before)
+	}
+}
+
+// Clients the server removes while their peers stay connected (here by quitting) still have
+// both their goroutines return, as removal closes the connection Read is blocked on.
+func TestRemovedNoLeaks(t *testing.T) {
+	const numClients = 10
+	h := makeTestHub()
+	cfg := defaultConfig()
+	cfg.Port = "13515"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.runListener(ctx, cfg, nil)
+	dialTestListener(t, "127.0.0.1:13515").Close()
+	for h.ClientCount() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < numClients; i++ {
+		conn := dialTestListener(t, "127.0.0.1:13515")
+		defer conn.Close()
+		if _, err := conn.Write([]byte("quit\n")); err != nil {
+			t.Fatalf("TestRemovedNoLeaks: returned err on write (%s)", err.Error())
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ioutil.ReadAll(conn); err != nil {
+			t.Fatalf("TestRemovedNoLeaks: connection not closed after quit (%s)", err.Error())
+		}
+	}
+
+	after := runtime.NumGoroutine()
+	for i := 0; after > before && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Errorf("TestRemovedNoLeaks: %d goroutines after clients quit, want at most %d", after, before)
+	}
+}
+
+func TestServeListenerClosed(t *testing.T) {
+	h := makeTestHub()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServeListenerClosed: returned err on listen (%s)", err.Error())
+	}
+	done := make(chan error)
+	go func() { done <- h.serve(context.Background(), l) }()
+
+	l.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("TestServeListenerClosed: serve returned nil err, want accept err")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestServeListenerClosed: serve didn't return after listener closed")
+	}
+}
+
+// Reads the messages a client is sent on connecting, up to the end of the dump.
+func readWelcome(t *testing.T, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("readWelcome: returned err on read (%s)", err.Error())
+		}
+		// The dump ends with the playlist, which is empty in tests
+		if strings.HasPrefix(line, "COUNT") {
+			return
+		}
+	}
+}
+
+// Drives a request through to the downstream service and its response back, all in memory.
+func TestServeClient(t *testing.T) {
+	h := makeTestHub()
+	cReqCh, cResCh := make(chan baps3.Message), make(chan baps3.Message)
+	h.setConnector(cReqCh, cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+
+	readWelcome(t, reader)
+
+	go other.Write([]byte("play\n"))
+	select {
+	case req := <-cReqCh:
+		if req.Word() != baps3.RqPlay {
+			t.Errorf("TestServeClient: downstream got %q, want play", req.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestServeClient: request not forwarded downstream")
+	}
+
+	cResCh <- *baps3.NewMessage(baps3.RsState).AddArg("Playing")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestServeClient: returned err on response read (%s)", err.Error())
+	}
+	if line != "STATE Playing\n" {
+		t.Errorf("TestServeClient: got %q, want %q", line, "STATE Playing\n")
+	}
+}
+
+// Routes play to a second connector, whose responses reach clients without touching the playout state.
+func TestConnectorRouting(t *testing.T) {
+	h := makeTestHub()
+	cReqCh := make(chan baps3.Message, 1)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	h.addConnector("other", nil, []baps3.MessageWord{baps3.RqPlay})
+	oReqCh, oResCh := make(chan baps3.Message), make(chan baps3.Message)
+	h.connectors[1].reqCh, h.connectors[1].resCh = oReqCh, oResCh
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+
+	readWelcome(t, reader)
+
+	go other.Write([]byte("play\n"))
+	select {
+	case req := <-oReqCh:
+		if req.Word() != baps3.RqPlay {
+			t.Errorf("TestConnectorRouting: other connector got %q, want play", req.String())
+		}
+	case req := <-cReqCh:
+		t.Fatalf("TestConnectorRouting: playout system got %q", req.String())
+	case <-time.After(time.Second):
+		t.Fatalf("TestConnectorRouting: request not forwarded")
+	}
+
+	oResCh <- *baps3.NewMessage(baps3.RsState).AddArg("Playing")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestConnectorRouting: returned err on response read (%s)", err.Error())
+	}
+	if line != "STATE Playing\n" {
+		t.Errorf("TestConnectorRouting: got %q, want %q", line, "STATE Playing\n")
+	}
+	if state := h.makeDumpResponses()[0].String(); state == "STATE Playing" {
+		t.Errorf("TestConnectorRouting: other connector changed the playout state")
+	}
+}
+
+// Requests go to whichever connector handles their word, and what it answers goes back to clients.
+func TestRouting(t *testing.T) {
+	playout, other := newMockConnector(), newMockConnector()
+	playout.answer(baps3.RqStop, baps3.NewMessage(baps3.RsState).AddArg("Stopped"))
+	playout.answer(baps3.RqSeek, baps3.NewMessage(baps3.RsTime).AddArg("1000"))
+	other.answer(baps3.RqPlay, baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	cfg.TimeInterval = duration{0}
+	s := InitServer(cfg, playout.dial, WithConnector("other", other.dial, "play"))
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+
+	addr := s.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("TestRouting: returned err dialling %s (%s)", addr, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	readWelcome(t, reader)
+
+	cases := []struct {
+		req  string
+		conn *mockConnector
+		res  string
+	}{
+		{"play\n", other, "STATE Playing\n"},
+		{"stop\n", playout, "STATE Stopped\n"},
+		{"seek 1000\n", playout, "TIME 1000\n"},
+	}
+	for _, c := range cases {
+		if _, err := conn.Write([]byte(c.req)); err != nil {
+			t.Fatalf("TestRouting: returned err writing %q (%s)", c.req, err.Error())
+		}
+		if req := c.conn.next(t); req.String()+"\n" != c.req {
+			t.Errorf("TestRouting: connector got %q, want %q", req.String(), c.req)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("TestRouting: returned err reading the answer to %q (%s)", c.req, err.Error())
+		}
+		if line != c.res {
+			t.Errorf("TestRouting: %q got %q, want %q", c.req, line, c.res)
+		}
+	}
+	if n := len(playout.requests()); n != 2 {
+		t.Errorf("TestRouting: playout system got %d requests, want 2", n)
+	}
+	if n := len(other.requests()); n != 1 {
+		t.Errorf("TestRouting: other connector got %d requests, want 1", n)
+	}
+}
+
+func TestCachedResponses(t *testing.T) {
+	h := makeTestHub()
+	cResCh := make(chan baps3.Message)
+	h.setConnector(make(chan baps3.Message), cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	// Sent before anyone's connected, so only the cache can get it to the client
+	cResCh <- *baps3.NewMessage(baps3.RsFile).AddArg("song.mp3")
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+
+	readWelcome(t, reader)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestCachedResponses: returned err on read (%s)", err.Error())
+	}
+	if line != "FILE song.mp3\n" {
+		t.Errorf("TestCachedResponses: got %q, want %q", line, "FILE song.mp3\n")
+	}
+}
+
+func TestSuppressedResponses(t *testing.T) {
+	h := makeTestHub()
+	h.config.SuppressedResponses = []string{"DURATION"}
+	cResCh := make(chan baps3.Message)
+	h.setConnector(make(chan baps3.Message), cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+	readWelcome(t, reader)
+
+	cResCh <- *baps3.NewMessage(baps3.RsDuration).AddArg("1000")
+	cResCh <- *baps3.NewMessage(baps3.RsState).AddArg("Playing")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestSuppressedResponses: returned err on read (%s)", err.Error())
+	}
+	if line != "STATE Playing\n" {
+		t.Errorf("TestSuppressedResponses: got %q, want %q", line, "STATE Playing\n")
+	}
+}
+
+// With STATE deduplicated, a client only gets a repeated STATE again once it has changed, though
+// TIMEs and heartbeats still get through.
+func TestDedupResponses(t *testing.T) {
+	h := makeTestHub()
+	h.config.DedupResponses = []string{"STATE"}
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	for _, state := range []string{"Playing", "Playing", "Playing", "Stopped", "Playing"} {
+		h.broadcastResponse(*baps3.NewMessage(baps3.RsState).AddArg(state))
+	}
+	for _, want := range []string{"STATE Playing", "STATE Stopped", "STATE Playing"} {
+		if res := <-c.resCh; res.String() != want {
+			t.Errorf("TestDedupResponses: got %q, want %q", res.String(), want)
+		}
+	}
+	if n := len(c.resCh); n != 0 {
+		t.Errorf("TestDedupResponses: %d repeated STATEs sent, want none", n)
+	}
+
+	h.downstreamState.State = baps3.StPlaying
+	h.sendHeartbeat()
+	if n := len(c.resCh); n != 1 {
+		t.Errorf("TestDedupResponses: heartbeat not sent")
+	}
+
+	for i := 0; i < 2; i++ {
+		h.broadcastResponse(*baps3.NewMessage(baps3.RsTime).AddArg("1000"))
+	}
+	if n := len(c.lowCh); n != 2 {
+		t.Errorf("TestDedupResponses: %d TIMEs sent, want 2", n)
+	}
+}
+
+func TestThrottleTime(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	h := makeTestHub()
+	h.config.TimeInterval.Duration = interval
+	cResCh := make(chan baps3.Message)
+	h.setConnector(make(chan baps3.Message), cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+	readWelcome(t, reader)
+
+	start := time.Now()
+	for _, usec := range []string{"1", "2", "3"} {
+		cResCh <- *baps3.NewMessage(baps3.RsTime).AddArg(usec)
+	}
+	// The first goes straight out, the second is replaced by the third, and the third waits
+	for _, want := range []string{"TIME 1\n", "TIME 3\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("TestThrottleTime: returned err on read (%s)", err.Error())
+		}
+		if line != want {
+			t.Errorf("TestThrottleTime: got %q, want %q", line, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("TestThrottleTime: second TIME after %s, want at least %s", elapsed, interval)
+	}
+}
+
+// A connection that claims to come from addr, to simulate clients on other hosts.
+type fakeAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c fakeAddrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestMaxClientsPerAddr(t *testing.T) {
+	const maxPerAddr = 2
+	h := makeTestHub()
+	h.config.MaxClientsPerAddr = maxPerAddr
+	cReqCh := make(chan baps3.Message, 1)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	one := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+
+	newClient := func(addr net.Addr) *Client {
+		conn, _ := net.Pipe()
+		c := h.newClient(fakeAddrConn{conn, addr})
+		h.addClient(c)
+		return c
+	}
+
+	var fromOne []*Client
+	for i := 0; i <= maxPerAddr; i++ {
+		fromOne = append(fromOne, newClient(one))
+	}
+	for i, c := range fromOne {
+		_, registered := h.clients[c]
+		if i < maxPerAddr && !registered {
+			t.Errorf("TestMaxClientsPerAddr: connection %d refused when under limit", i)
+		} else if i == maxPerAddr && registered {
+			t.Errorf("TestMaxClientsPerAddr: connection %d registered, want refusal", i)
+		}
+	}
+	if _, ok := h.clients[newClient(other)]; !ok {
+		t.Errorf("TestMaxClientsPerAddr: connection from another address refused")
+	}
+
+	// The limit is on traffic, not just registrations
+	h.handleRequest(clientAndMessage{c: fromOne[maxPerAddr], msg: *baps3.NewMessage(baps3.RqPlay)})
+	if len(cReqCh) != 0 {
+		t.Errorf("TestMaxClientsPerAddr: request from refused connection sent downstream")
+	}
+
+	// Leaving frees up a slot
+	h.removeClient(fromOne[0])
+	if _, ok := h.clients[newClient(one)]; !ok {
+		t.Errorf("TestMaxClientsPerAddr: connection refused after another left")
+	}
+}
+
+// While draining, new clients are refused, but those already connected are still served.
+func TestDrain(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"admin": "token"}
+	h.config.Admins = []string{"admin"}
+	cReqCh := make(chan baps3.Message, 1)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	admin, adminOther := makeTestClient(h)
+	defer adminOther.Close()
+	admin.user = "admin"
+
+	h.processLocalRequest(admin, []string{"drain", "on"})
+	if res := <-admin.resCh; res.String() != "OK drain on" {
+		t.Fatalf("TestDrain: got %q, want %q", res.String(), "OK drain on")
+	}
+	conn, other := net.Pipe()
+	defer other.Close()
+	refused := h.newClient(conn)
+	h.addClient(refused)
+	if res := <-refused.resCh; res.String() != "FAIL Draining" {
+		t.Errorf("TestDrain: new client got %q, want it refused", res.String())
+	}
+	h.handleRequest(clientAndMessage{c: refused, local: []string{"iam", "admin", "token"}})
+	h.handleRequest(clientAndMessage{c: refused, msg: *baps3.NewMessage(baps3.RqPlay)})
+	if len(cReqCh) != 0 {
+		t.Errorf("TestDrain: request from refused client sent downstream")
+	}
+	if _, ok := h.clients[admin]; !ok {
+		t.Errorf("TestDrain: connected client removed by draining")
+	}
+
+	h.processLocalRequest(admin, []string{"drain", "off"})
+	<-admin.resCh
+	conn, other = net.Pipe()
+	defer other.Close()
+	accepted := h.newClient(conn)
+	h.addClient(accepted)
+	if _, ok := h.clients[accepted]; !ok {
+		t.Errorf("TestDrain: new client refused after draining stopped")
+	}
+}
+
+func TestRecoverClientPanic(t *testing.T) {
+	h := makeTestHub()
+	h.logger = newStdLogger(levelError + 1) // Don't fill the test output with the stack
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	// Without a tokeniser, Read panics on the first thing it reads
+	badConn, badOther := net.Pipe()
+	defer badOther.Close()
+	bad := h.newClient(badConn)
+	bad.tok = nil
+	go h.serveClient(ctx, bad)
+	badReader := bufio.NewReader(badOther)
+	badOther.SetDeadline(time.Now().Add(time.Second))
+	readWelcome(t, badReader)
+	badOther.Write([]byte("dump\n"))
+	if _, err := ioutil.ReadAll(badReader); err != nil {
+		t.Errorf("TestRecoverClientPanic: panicking client not disconnected (%s)", err.Error())
+	}
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+	readWelcome(t, reader)
+	go other.Write([]byte("dump\n"))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "STATE") {
+		t.Errorf("TestRecoverClientPanic: after panic, dump got %q (err %v), want STATE", line, err)
+	}
+}
+
+// Packs msg and splits it into its words, sorted so order doesn't matter.
+func sortedWords(t *testing.T, msg *baps3.Message) []string {
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("sortedWords: returned err on pack (%s)", err.Error())
+	}
+	words := strings.Fields(string(data))
+	sort.Strings(words)
+	return words
+}
+
+// Read and Write both giving up on a client removes it once, rather than closing its resCh twice.
+func TestClientGoneTwice(t *testing.T) {
+	h := makeTestHub()
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.clientGone(c)
+	h.clientGone(c)
+	if _, ok := h.clients[c]; ok || !c.isRemoved() {
+		t.Errorf("TestClientGoneTwice: client still registered")
+	}
+}
+
+// Removing a client that has already been removed does nothing, rather than closing its resCh
+// again, or counting it out twice.
+func TestRemoveClientTwice(t *testing.T) {
+	h := makeTestHub()
+	c, other := makeTestClient(h)
+	defer other.Close()
+	stays, staysOther := makeTestClient(h)
+	defer staysOther.Close()
+
+	h.removeClient(c)
+	h.removeClient(c)
+	if _, ok := h.clients[c]; ok || !c.isRemoved() {
+		t.Errorf("TestRemoveClientTwice: client still registered")
+	}
+	if _, ok := h.clients[stays]; !ok || h.ClientCount() != 1 {
+		t.Errorf("TestRemoveClientTwice: %d clients registered, want 1", h.ClientCount())
+	}
+}
+
+// Shutting down with a client that has no room for the goodbye removes it once, as slow, rather
+// than removing it again and closing its resCh twice.
+func TestCloseClientsFullBuffer(t *testing.T) {
+	h := makeTestHub()
+	h.config.ResponseBuffer = 1
+	full, fullOther := makeTestClient(h)
+	defer fullOther.Close()
+	full.resCh <- response{}
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	if closing := h.closeClients(); len(closing) != 2 {
+		t.Errorf("TestCloseClientsFullBuffer: closed %d clients, want 2", len(closing))
+	}
+	if len(h.clients) != 0 || !full.isRemoved() || !c.isRemoved() {
+		t.Errorf("TestCloseClientsFullBuffer: %d clients still registered", len(h.clients))
+	}
+}
+
+func TestMakeRsOhai(t *testing.T) {
+	h := makeTestHub()
+	h.config.ServerName, h.config.ServerVersion = "test-listd", "9.9"
+	h.downstreamState.Identifier = "playd 1.0"
+
+	if ohai, _ := h.makeRsOhai().Arg(0); ohai != "test-listd 9.9/playd 1.0" {
+		t.Errorf("TestMakeRsOhai: got %q, want %q", ohai, "test-listd 9.9/playd 1.0")
+	}
+}
+
+func TestMakeRsFeatures(t *testing.T) {
+	h := makeTestHub()
+	for _, f := range MASKED_FEATURES {
+		h.downstreamState.Features.AddFeature(f)
+	}
+
+	want := baps3.InitServiceState().Features
+	for _, f := range LISTD_FEATURES {
+		want.AddFeature(f)
+	}
+
+	if got, want := sortedWords(t, h.makeRsFeatures(&Client{})), sortedWords(t, want.ToMessage().AddArg(SEQUENCE_FEATURE)); !reflect.DeepEqual(got, want) {
+		t.Errorf("TestMakeRsFeatures: got %q, want %q", got, want)
+	}
+}
+
+func TestBroadcastSlowClient(t *testing.T) {
+	const numMsgs = 10
+	h := makeTestHub()
+	h.config.ResponseBuffer = 2
+
+	// Nothing ever reads the stuck client's resCh
+	stuckConn, stuckOther := net.Pipe()
+	defer stuckOther.Close()
+	stuck := &Client{id: nextClientID(), conn: stuckConn, resCh: make(chan response, h.config.ResponseBuffer)}
+	h.clients[stuck] = true
+
+	// The good client has room for everything, as if it were reading promptly
+	good := &Client{id: nextClientID(), resCh: make(chan response, numMsgs)}
+	h.clients[good] = true
+
+	for i := 0; i < numMsgs; i++ {
+		h.broadcast(*baps3.NewMessage(baps3.RsCount).AddArg(strconv.Itoa(i)))
+	}
+	if _, ok := h.clients[stuck]; ok {
+		t.Errorf("TestBroadcastSlowClient: stuck client still registered")
+	}
+	if n := len(good.resCh); n != numMsgs {
+		t.Errorf("TestBroadcastSlowClient: good client got %d responses, want %d", n, numMsgs)
+	}
+}
+
+// A welcome far bigger than a client's buffer is queued without waiting for the client to take
+// any of it, so a client that never does can't hold up the hub.
+func TestWelcomeNotBlocking(t *testing.T) {
+	const numItems = 2000
+	h := makeTestHub()
+	for i := 0; i < numItems; i++ {
+		h.pl.items = append(h.pl.items, &PlaylistItem{Data: "track" + strconv.Itoa(i), Hash: strconv.Itoa(i)})
+	}
+	// Nothing ever reads the client's resCh
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := h.newClient(conn)
+
+	added := make(chan struct{})
+	go func() {
+		h.addClient(c)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("TestWelcomeNotBlocking: addClient blocked on a client not reading")
+	}
+	if _, ok := h.clients[c]; !ok {
+		t.Fatalf("TestWelcomeNotBlocking: client not registered")
+	}
+	if welcome := <-c.resCh; len(welcome.burst) < numItems {
+		t.Errorf("TestWelcomeNotBlocking: welcome has %d responses, want the whole playlist", len(welcome.burst))
+	}
+}
+
+// With buffered channels, a client leaving before the hub has got round to registering it is
+// still registered and then removed, rather than left registered for good.
+func TestChannelBufferLeaveFirst(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ChannelBuffer = 1
+	h := initHub(cfg, newStdLogger(levelInfo), nil)
+	conn, other := net.Pipe()
+	defer other.Close()
+	c := h.newClient(conn)
+
+	h.addCh <- c
+	h.catchUpAdds(c)
+	h.clientGone(c)
+	if len(h.clients) != 0 || len(h.addCh) != 0 {
+		t.Errorf("TestChannelBufferLeaveFirst: %d clients registered and %d waiting, want none", len(h.clients), len(h.addCh))
+	}
+}
+
+// Simulates a storm of clients connecting and leaving at once, with and without buffering
+// between them and the hub.
+func BenchmarkConnectStorm(b *testing.B) {
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			cfg := defaultConfig()
+			cfg.MaxClients, cfg.ChannelBuffer = 1<<30, size
+			h := initHub(cfg, newStdLogger(levelError), nil)
+			h.setConnector(make(chan baps3.Message), make(chan baps3.Message))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go h.serve(ctx, nil)
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, other := net.Pipe()
+					c := h.newClient(conn)
+					h.addCh <- c
+					h.rmCh <- c
+					conn.Close()
+					other.Close()
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	const numClients = 200
+	h := makeTestHub()
+
+	clients := make([]*Client, numClients)
+	for i := range clients {
+		clients[i] = &Client{id: nextClientID(), lowCh: make(chan response, h.config.ResponseBuffer)}
+		h.clients[clients[i]] = true
+	}
+	msg := *baps3.NewMessage(baps3.RsTime).AddArg("1000")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.broadcast(msg)
+		// Stand in for each client's Write, so no buffer ever fills
+		for _, c := range clients {
+			res := <-c.lowCh
+			ioutil.Discard.Write(res.packed)
+		}
+	}
+}
+
+// Every client sees a run of broadcasts in the order they were sent, whatever order the clients
+// are sent each one in, and however Write batches them.
+func TestBroadcastOrder(t *testing.T) {
+	const numClients, numResponses = 5, 50
+	h := makeTestHub()
+	h.config.ResponseBuffer = numResponses
+	var others []net.Conn
+	for i := 0; i < numClients; i++ {
+		c, other := makeTestClient(h)
+		defer other.Close()
+		go c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+		others = append(others, other)
+	}
+
+	for i := 0; i < numResponses; i++ {
+		h.broadcast(*baps3.NewMessage(baps3.RsTime).AddArg(strconv.Itoa(i)))
+	}
+
+	for _, other := range others {
+		r := bufio.NewReader(other)
+		other.SetReadDeadline(time.Now().Add(time.Second))
+		for i := 0; i < numResponses; i++ {
+			want := fmt.Sprintf("TIME %d\n", i)
+			if line, err := r.ReadString('\n'); line != want {
+				t.Fatalf("TestBroadcastOrder: got %q (%v), want %q", line, err, want)
+			}
+		}
+	}
+}
+
+// A list far longer than clients' buffers is one request's reply, so reaches every client that's
+// reading, rather than getting them disconnected as slow.
+func TestBroadcastLongList(t *testing.T) {
+	const numClients, numItems = 5, 300
+	h := makeTestHub()
+	for i := 0; i < numItems; i++ {
+		h.pl.items = append(h.pl.items, &PlaylistItem{Data: "track" + strconv.Itoa(i), Hash: strconv.Itoa(i)})
+	}
+	var clients []*Client
+	var others []net.Conn
+	for i := 0; i < numClients; i++ {
+		c, other := makeTestClient(h)
+		defer other.Close()
+		go c.Write(context.Background(), c.resCh, make(chan *Client, 1))
+		clients = append(clients, c)
+		others = append(others, other)
+	}
+
+	h.processRequest(clients[0], *baps3.NewMessage(baps3.RqList), "")
+
+	for i, other := range others {
+		if _, ok := h.clients[clients[i]]; !ok {
+			t.Fatalf("TestBroadcastLongList: client %d disconnected", i)
+		}
+		r := bufio.NewReader(other)
+		other.SetReadDeadline(time.Now().Add(time.Second))
+		for j := 0; j <= numItems; j++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatalf("TestBroadcastLongList: client %d got %d lines (%v), want %d", i, j, err, numItems+1)
+			}
+		}
+	}
+}
+
+// Clients that turn on sequence numbers get them on every broadcast; everyone else doesn't.
+func TestBroadcastSequence(t *testing.T) {
+	h := makeTestHub()
+	seq, otherSeq := makeTestClient(h)
+	defer otherSeq.Close()
+	plain, otherPlain := makeTestClient(h)
+	defer otherPlain.Close()
+
+	h.processLocalRequest(seq, []string{"sequence", "on"})
+	if res := <-seq.resCh; res.String() != "OK sequence on" {
+		t.Fatalf("TestBroadcastSequence: got %q, want %q", res.String(), "OK sequence on")
+	}
+	for i := 0; i < 2; i++ {
+		h.broadcast(*baps3.NewMessage(baps3.RsCount).AddArg(strconv.Itoa(i)))
+	}
+
+	for i, want := range []string{"#1 COUNT 0\n", "#2 COUNT 1\n"} {
+		if got := string((<-seq.resCh).packed); got != want {
+			t.Errorf("TestBroadcastSequence: broadcast %d got %q, want %q", i, got, want)
+		}
+	}
+	for i, want := range []string{"COUNT 0\n", "COUNT 1\n"} {
+		if got := string((<-plain.resCh).packed); got != want {
+			t.Errorf("TestBroadcastSequence: broadcast %d without sequence got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	h := initHub(defaultConfig(), newStdLogger(levelInfo), nil)
+	sender, senderOther := makeTestClient(h)
+	defer senderOther.Close()
+	bystander, bystanderOther := makeTestClient(h)
+	defer bystanderOther.Close()
+
+	h.config.Standalone = "echo"
+	h.handleRequest(clientAndMessage{c: sender, msg: *baps3.NewMessage(baps3.RqPlay)})
+	if res := <-sender.resCh; res.String() != "play" {
+		t.Errorf("TestStandalone: echo mode sent back %q, want %q", res.String(), "play")
+	}
+	if n := len(bystander.resCh); n != 0 {
+		t.Errorf("TestStandalone: echo mode sent %d responses to another client, want 0", n)
+	}
+
+	h.config.Standalone = "broadcast"
+	h.handleRequest(clientAndMessage{c: sender, msg: *baps3.NewMessage(baps3.RqStop)})
+	for _, c := range []*Client{sender, bystander} {
+		if res := <-c.resCh; res.String() != "stop" {
+			t.Errorf("TestStandalone: broadcast mode sent %v %q, want %q", c, res.String(), "stop")
+		}
+	}
+}
+
+// A connector that has stopped reading requests fails them, rather than freezing the hub.
+func TestConnectorNotReading(t *testing.T) {
+	h := makeTestHub()
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqPlay)})
+		if took := time.Since(start); took > CONNECTOR_SEND_TIMEOUT+time.Second {
+			t.Fatalf("TestConnectorNotReading: request %d held up the hub for %s", i, took)
+		}
+		if res := <-c.resCh; res.String() != "FAIL Downstream service unavailable play" {
+			t.Errorf("TestConnectorNotReading: request %d got %q, want it to fail", i, res.String())
+		}
+	}
+	if status := h.downstream.status(); status != "unhealthy" {
+		t.Errorf("TestConnectorNotReading: connector %s, want unhealthy", status)
+	}
+}
+
+func TestReconnectQueue(t *testing.T) {
+	h := makeTestHub()
+	h.config.ReconnectQueue = 1
+	h.downstream.dial = func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		return nil, nil, fmt.Errorf("not now")
+	}
+	h.setConnector(nil, nil)
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqPlay)})
+	if n := len(c.resCh); n != 0 {
+		t.Fatalf("TestReconnectQueue: got %d responses to a held request, want 0", n)
+	}
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqStop)})
+	if res := <-c.resCh; res.Word() != baps3.RsFail {
+		t.Errorf("TestReconnectQueue: request beyond the queue got %q, want FAIL", res.String())
+	}
+
+	cReqCh := make(chan baps3.Message, 2)
+	h.setConnector(cReqCh, make(chan baps3.Message))
+	h.flushQueued(h.downstream)
+	if len(cReqCh) != 1 {
+		t.Fatalf("TestReconnectQueue: %d requests sent on reconnecting, want 1", len(cReqCh))
+	}
+	if req := <-cReqCh; req.Word() != baps3.RqPlay {
+		t.Errorf("TestReconnectQueue: sent %q on reconnecting, want play", req.String())
+	}
+}
+
+// Once the playout system is back, it's asked for its state, which everyone is sent.
+func TestReconnectResync(t *testing.T) {
+	h := makeTestHub()
+	mock := newMockConnector()
+	mock.answer(baps3.RqDump, baps3.NewMessage(baps3.RsState).AddArg("Playing"))
+	h.downstream.dial = mock.dial
+	cResCh := make(chan baps3.Message)
+	h.setConnector(make(chan baps3.Message), cResCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.serve(ctx, nil)
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	go h.serveClient(ctx, h.newClient(conn))
+	other.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(other)
+	readWelcome(t, reader)
+
+	close(cResCh)
+	if req := mock.next(t); req.Word() != baps3.RqDump {
+		t.Errorf("TestReconnectResync: sent %q on reconnecting, want dump", req.String())
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("TestReconnectResync: returned err on response read (%s)", err.Error())
+	}
+	if line != "STATE Playing\n" {
+		t.Errorf("TestReconnectResync: got %q, want %q", line, "STATE Playing\n")
+	}
+}
+
+// Shutdown waits for reconnect to give up, as for any other goroutine serving a connector.
+func TestReconnectWaited(t *testing.T) {
+	h := makeTestHub()
+	dialling, release := make(chan bool), make(chan bool)
+	h.downstream.dial = func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		dialling <- true
+		<-release
+		return nil, nil, fmt.Errorf("not now")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.handleDownstreamClosed(ctx, h.downstream)
+	<-dialling
+	cancel()
+
+	done := make(chan bool)
+	go func() {
+		h.connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("TestReconnectWaited: stopped waiting while still dialling")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("TestReconnectWaited: reconnect still running after its ctx was cancelled")
+	}
+}
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	envs := []map[string]string{
+		{},
+		{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+		{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "0"},
+	}
+	for _, env := range envs {
+		l, activated, err := systemdListener(func(name string) string { return env[name] })
+		if l != nil || activated || err != nil {
+			t.Errorf("TestSystemdListenerNotActivated: %v gave listener %v, activated %v, err %v; want none", env, l, activated, err)
+		}
+	}
+}
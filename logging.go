@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// How important a log message is. Messages below the minimum level are not logged.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var LOG_LEVEL_NAMES = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return LOG_LEVEL_NAMES[l]
+}
+
+// Converts a level name, as used in the config, into a logLevel.
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range LOG_LEVEL_NAMES {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("Unknown log level %q", name)
+}
+
+// Logger is where the hub and its clients send log messages, one method per level.
+// Arguments are handled as with log.Println.
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+// The default Logger, which writes to the standard log package.
+// Messages less important than minLevel are dropped. minLevel is accessed atomically, so it can
+// be changed while in use.
+type stdLogger struct {
+	minLevel int32
+}
+
+func newStdLogger(minLevel logLevel) *stdLogger {
+	return &stdLogger{minLevel: int32(minLevel)}
+}
+
+func (l *stdLogger) setMinLevel(minLevel logLevel) {
+	atomic.StoreInt32(&l.minLevel, int32(minLevel))
+}
+
+func (l *stdLogger) output(level logLevel, v ...interface{}) {
+	if int32(level) < atomic.LoadInt32(&l.minLevel) {
+		return
+	}
+	// Skip output and its caller, so the file:line is where the message came from
+	log.Output(3, strings.ToUpper(level.String())+": "+fmt.Sprintln(v...))
+}
+
+func (l *stdLogger) Debug(v ...interface{}) { l.output(levelDebug, v...) }
+func (l *stdLogger) Info(v ...interface{})  { l.output(levelInfo, v...) }
+func (l *stdLogger) Warn(v ...interface{})  { l.output(levelWarn, v...) }
+func (l *stdLogger) Error(v ...interface{}) { l.output(levelError, v...) }
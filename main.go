@@ -1,35 +1,143 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
 	"syscall"
+	"time"
 
-	baps3 "github.com/UniversityRadioYork/baps3-go"
 	"github.com/docopt/docopt-go"
 )
 
-var LD_VERSION string
+// The server name listd advertises in its OHAI, unless configured otherwise.
+const LD_NAME = "listd"
+
+// Set at build time with -ldflags "-X main.LD_VERSION ..." (see script/build).
+var LD_VERSION = "dev"
+
+// Also set at build time, if at all: the commit built, and when, for the version request.
+var (
+	LD_COMMIT     = ""
+	LD_BUILD_DATE = ""
+)
 
 func parseArgs() (args map[string]interface{}, err error) {
 	usage := `ury-listd-go.
 
 Usage:
-  ury-listd-go [-p <port>] [-a <address>] [-P <port>] [-A <address>]
+  ury-listd-go [-c <file>] [-p <port>] [-a <address>] [-P <port>] [-A <address>] [-m <clients>] [-r <duration>] [-w <duration>] [-i <duration>] [-b <duration>] [-l <level>] [--cert=<file> --key=<file> [--client-ca=<file>]] [--standalone=<mode>] [--debug-addr=<address>] [--health-addr=<address>]
   ury-listd-go -h
   ury-listd-go -v
 
+Options given here override LISTD_* environment variables, such as LISTD_PORT and
+LISTD_READ_TIMEOUT, which override the config file. Send SIGHUP to reload them all
+without disconnecting anyone; addresses and TLS only change on restart. Send SIGUSR1 to
+drain, refusing new clients but serving those connected, and SIGUSR2 to stop. Under systemd
+socket activation, the socket systemd passes is used instead of --addr and --port.
+
 Options:
-  -p --port=<port>              The port ury-listd-go listens on [default: 1351].
-  -a --addr=<address>           The host ury-listd-go listens on [default: 127.0.0.1].
-  -P --playoutport=<port>       The playout system's listening port [default: 1350].
-  -A --playoutaddr=<address>    The playout system's listening address [default: 127.0.0.1].
+  -c --config=<file>            JSON config file to load.
+  -p --port=<port>              The port ury-listd-go listens on (default 1351).
+  -a --addr=<address>           The host, or unix:// socket path, ury-listd-go listens on (default 127.0.0.1).
+  -P --playoutport=<port>       The playout system's listening port (default 1350).
+  -A --playoutaddr=<address>    The playout system's listening address (default 127.0.0.1).
+  -m --maxclients=<clients>     The maximum number of concurrent clients (default 1024).
+  -r --readtimeout=<duration>   Disconnect clients silent for this long, e.g. 5m; 0 disables (default 0).
+  -w --writetimeout=<duration>  Disconnect clients taking this long to accept a response; 0 disables (default 0).
+  -i --idletimeout=<duration>   Disconnect clients neither sending nor receiving for this long; 0 disables (default 0).
+  -b --heartbeat=<duration>     Send clients a heartbeat this often; 0 disables (default 0).
+  -l --loglevel=<level>         Least important messages to log: debug, info, warn or error (default info).
+  --cert=<file>                 Certificate file to serve TLS with; needs --key.
+  --key=<file>                  Private key file to serve TLS with; needs --cert.
+  --client-ca=<file>            Only accept clients with a certificate signed by a CA in this file.
+  --standalone=<mode>           Connect to no playout system, sending requests back as if they were
+                                responses: to the sender in echo mode, or everyone in broadcast mode.
+  --debug-addr=<address>        Serve profiles over HTTP on this host:port, which should be loopback.
+  --health-addr=<address>       Serve /healthz and /readyz checks over HTTP on this host:port.
   -h --help                     Show this screen.
   -v --version                  Show version.`
 
-	return docopt.Parse(usage, nil, true, "ury-listd-go 0.0", false)
+	return docopt.Parse(usage, nil, true, "ury-listd-go "+LD_VERSION, false)
+}
+
+// Overrides the config with any options given as arguments.
+func applyArgs(cfg *Config, args map[string]interface{}) (err error) {
+	strOpts := map[string]*string{
+		"--addr":        &cfg.Addr,
+		"--port":        &cfg.Port,
+		"--playoutaddr": &cfg.PlayoutAddr,
+		"--playoutport": &cfg.PlayoutPort,
+		"--cert":        &cfg.CertFile,
+		"--key":         &cfg.KeyFile,
+		"--client-ca":   &cfg.ClientCAFile,
+		"--loglevel":    &cfg.LogLevel,
+		"--standalone":  &cfg.Standalone,
+		"--debug-addr":  &cfg.DebugAddr,
+		"--health-addr": &cfg.HealthAddr,
+	}
+	for opt, field := range strOpts {
+		if v, ok := args[opt].(string); ok {
+			*field = v
+		}
+	}
+
+	if v, ok := args["--maxclients"].(string); ok {
+		if cfg.MaxClients, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("Invalid max clients: %s", v)
+		}
+	}
+
+	durOpts := map[string]*duration{
+		"--readtimeout":  &cfg.ReadTimeout,
+		"--writetimeout": &cfg.WriteTimeout,
+		"--idletimeout":  &cfg.IdleTimeout,
+		"--heartbeat":    &cfg.HeartbeatInterval,
+	}
+	for opt, field := range durOpts {
+		if v, ok := args[opt].(string); ok {
+			if field.Duration, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("Invalid %s: %s", opt, v)
+			}
+		}
+	}
+	return
+}
+
+// Makes the config from the config file (if any), environment and args, in that order,
+// on top of the defaults.
+func makeConfig(args map[string]interface{}) (cfg *Config, err error) {
+	cfg = defaultConfig()
+	if path, ok := args["--config"].(string); ok {
+		if cfg, err = loadConfig(path); err != nil {
+			return
+		}
+	}
+	if err = applyEnv(cfg, os.Getenv); err != nil {
+		return
+	}
+	if err = applyArgs(cfg, args); err != nil {
+		return
+	}
+	err = cfg.validate()
+	return
+}
+
+// Remakes the config, as on SIGHUP, and switches server to it.
+// If the new config is no good, the old one is kept.
+func reloadConfig(server *Server, args map[string]interface{}, logger Logger) {
+	logger.Info("Reloading config")
+	cfg, err := makeConfig(args)
+	if err == nil {
+		err = server.Reload(cfg)
+	}
+	if err != nil {
+		logger.Error("Not reloading config:", err.Error())
+	}
 }
 
 func main() {
@@ -39,45 +147,45 @@ func main() {
 		log.Fatal("Error parsing args: " + err.Error())
 	}
 
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGINT)
-
-	responseCh := make(chan baps3.Message)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	connLog := log.New(os.Stderr, "playd:", 0)
-	connector := baps3.InitConnector("", responseCh, wg, connLog)
-	connector.Connect(args["--playoutaddr"].(string) + ":" + args["--playoutport"].(string))
-	go connector.Run()
-
-	var h = hub{
-		clients: make(map[*Client]bool),
-
-		downstreamState: *baps3.InitServiceState(),
+	cfg, err := makeConfig(args)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-		pl: InitPlaylist(),
+	logger := newStdLogger(cfg.logLevel)
+	logger.Info("Starting", cfg.ServerName, LD_VERSION)
 
-		reqCh: make(chan clientAndMessage),
+	// Buffered, as signals that come while the last is being handled (a reload, say) are dropped otherwise
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
-		addCh: make(chan *Client),
-		rmCh:  make(chan *Client),
-		Quit:  make(chan bool),
+	dialer := func(addr string, port string) dialFunc {
+		return dialTCP(net.JoinHostPort(addr, port), logger)
 	}
 
-	h.setConnector(connector.ReqCh, responseCh)
-
-	go h.runListener(args["--addr"].(string), args["--port"].(string))
-
-	// Signal handler loop
-	for {
-		select {
-		case <-sigs:
+	opts := []ServerOption{WithLogger(logger)}
+	for _, c := range cfg.Connectors {
+		opts = append(opts, WithConnector(c.Name, dialer(c.Addr, c.Port), c.Commands...))
+	}
+	server := InitServer(cfg, dialer(cfg.PlayoutAddr, cfg.PlayoutPort), opts...)
+	go func() {
+		for sig := range sigs {
+			switch sig {
+			case syscall.SIGHUP:
+				reloadConfig(server, args, logger)
+				continue
+			case syscall.SIGUSR1, syscall.SIGUSR2:
+				server.Drain(sig == syscall.SIGUSR1)
+				continue
+			}
 			log.Println("Exiting...")
-			h.Quit <- true
-			//<-h.Quit // Wait for quit to finish
-			close(connector.ReqCh)
-			wg.Wait()
-			os.Exit(0)
+			server.Shutdown(context.Background())
+			return
 		}
+	}()
+
+	// Returns once shut down, having closed the connectors
+	if err = server.ListenAndServe(); err != nil {
+		log.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Request middleware
+//
+// Every request a client sends goes down a chain of middleware before it's handled. Each one
+// looks at the request and either handles it itself (usually by refusing it, with a FAIL or WHAT
+// back to the client), or passes it, perhaps changed, to the next. Whatever gets past the end of
+// the chain is handled as a local request, or forwarded downstream, by dispatchRequest.
+//
+// The chain starts with DEFAULT_MIDDLEWARE, which has listd's own checks. Programs embedding
+// listd can add their own, after these, with WithMiddleware. Middleware runs within runListener's
+// loop, so it mustn't block, but may use anything on the hub.
+//
+
+// Passes a request further down the chain.
+type requestHandler func(data clientAndMessage)
+
+// One link in the request chain: handles data, or passes it on with next.
+type Middleware func(h *hub, data clientAndMessage, next requestHandler)
+
+// The middleware every request goes through, in order.
+var DEFAULT_MIDDLEWARE = []Middleware{
+	rejectBadRequests,
+	logRequests,
+	limitRequests,
+	requireAuthentication,
+	requireAllowedCommand,
+}
+
+// Sends data down h's middleware chain, and on to dispatchRequest if it gets to the end.
+// Requests from clients that aren't registered are dropped: a refused client's Read is already
+// running, so it can pipeline requests after the line it's refused on, and a removed client's
+// may still be passing on what it read before it was.
+func (h *hub) handleRequest(data clientAndMessage) {
+	if _, ok := h.clients[data.c]; !ok {
+		h.logger.Debug("Dropped request from unregistered", data.c)
+		return
+	}
+	h.runMiddleware(0, data)
+}
+
+// Runs the i'th middleware on data, with the rest of the chain as its next.
+func (h *hub) runMiddleware(i int, data clientAndMessage) {
+	if i == len(h.middleware) {
+		h.dispatchRequest(data)
+		return
+	}
+	h.middleware[i](h, data, func(data clientAndMessage) { h.runMiddleware(i+1, data) })
+}
+
+// Refuses requests the client's line couldn't be read as.
+func rejectBadRequests(h *hub, data clientAndMessage, next requestHandler) {
+	if data.err != nil {
+		h.send(data.c, *baps3.NewMessage(baps3.RsWhat).AddArg("Bad request").AddArg(data.err.Error()))
+		return
+	}
+	next(data)
+}
+
+// Writes every request to the access log, if there is one.
+func logRequests(h *hub, data clientAndMessage, next requestHandler) {
+	h.accessLog.logRequest(data.c, data.words())
+	next(data)
+}
+
+// Refuses requests from clients sending more than their rate limit allows.
+func limitRequests(h *hub, data clientAndMessage, next requestHandler) {
+	if data.c.limiter != nil && !data.c.limiter.allow() {
+		h.logger.Debug("Rate limited request from", data.c)
+		h.sendInvalidCmd(data.c, *baps3.NewMessage(baps3.RsFail).AddArg("Too many requests"), data.words())
+		return
+	}
+	next(data)
+}
+
+// Lets nothing but iam through until the client authenticates.
+func requireAuthentication(h *hub, data clientAndMessage, next requestHandler) {
+	if !h.isAuthenticated(data.c) && !(data.local != nil && data.local[0] == "iam") {
+		h.sendInvalidCmd(data.c, *makeNotAuthenticatedMsg(), data.words())
+		return
+	}
+	next(data)
+}
+
+// Refuses requests for commands the config doesn't allow. Local requests are always allowed.
+func requireAllowedCommand(h *hub, data clientAndMessage, next requestHandler) {
+	if data.local == nil && !h.config.commandAllowed(data.msg.Word().String()) {
+		h.logger.Info("Blocked request from", data.c, ":", data.msg.String())
+		h.sendInvalidCmd(data.c, *baps3.NewMessage(baps3.RsFail).AddArg("Command not allowed"), data.words())
+		return
+	}
+	next(data)
+}
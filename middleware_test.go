@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Middleware added after the built-ins can rewrite requests, or refuse them, and only sees what
+// the built-ins let through.
+func TestMiddleware(t *testing.T) {
+	h := makeTestHub()
+	h.config.Users = map[string]string{"alice": "secret"}
+	reqCh := make(chan baps3.Message, 1)
+	h.setConnector(reqCh, make(chan baps3.Message))
+	var seen []string
+	h.middleware = append(h.middleware, func(h *hub, data clientAndMessage, next requestHandler) {
+		seen = append(seen, data.msg.String())
+		switch data.msg.Word() {
+		case baps3.RqStop:
+			h.sendInvalidCmd(data.c, *baps3.NewMessage(baps3.RsFail).AddArg("No stopping"), data.words())
+		case baps3.RqSeek:
+			data.msg = *baps3.NewMessage(baps3.RqPlay)
+			next(data)
+		default:
+			next(data)
+		}
+	})
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqPlay)})
+	if res := <-c.resCh; res.String() != "FAIL Not authenticated play" {
+		t.Errorf("TestMiddleware: unauthenticated play got %q, want it refused", res.String())
+	}
+	if len(seen) != 0 {
+		t.Errorf("TestMiddleware: middleware saw %q, which should have been refused before it", seen)
+	}
+
+	c.user = "alice"
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqStop)})
+	if res := <-c.resCh; res.String() != "FAIL No stopping stop" {
+		t.Errorf("TestMiddleware: stop got %q, want it refused by the middleware", res.String())
+	}
+	h.handleRequest(clientAndMessage{c: c, msg: *baps3.NewMessage(baps3.RqSeek).AddArg("1000")})
+	if req := <-reqCh; req.Word() != baps3.RqPlay {
+		t.Errorf("TestMiddleware: seek forwarded as %q, want the middleware's play", req.String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// PROXY protocol
+//
+// A load balancer in front of listd makes every client look like it's connecting from the
+// balancer. With Config.ProxyProtocol on, each connection must start with a PROXY protocol
+// header (version 1 or 2, see haproxy's proxy-protocol.txt) giving the real client's address,
+// which is then used for everything: bans, per-address limits and logs. It must only be turned
+// on behind a trusted proxy, as otherwise clients could claim to be anyone.
+//
+
+// How long a connection has to send its PROXY header.
+const PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+// Longest a version 1 header can be, including its CRLF.
+const PROXY_V1_MAX_LENGTH = 107
+
+// What every version 2 header starts with.
+var PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A connection whose PROXY header has been read. Reads carry on from just after the header,
+// and RemoteAddr is the address the header gave.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Reads the PROXY header conn must start with, returning a connection that carries on after it,
+// with the real client's address. Headers that don't give an address, such as the proxy's own
+// health checks, leave the connection with the proxy's.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	start, err := r.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	switch {
+	case bytes.Equal(start, PROXY_V2_SIGNATURE):
+		remote, err = readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = readProxyV1(r)
+	default:
+		err = fmt.Errorf("No PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{conn, r, remote}, nil
+}
+
+// Reads a version 1 header: 'PROXY TCP4|TCP6 <src> <dst> <srcport> <dstport>', or 'PROXY UNKNOWN'.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > PROXY_V1_MAX_LENGTH || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("Bad PROXY header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Bad PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Bad PROXY source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Reads a version 2 header, which is binary: the signature, version and command, address
+// family and protocol, then the length of the addresses that follow.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(PROXY_V2_SIGNATURE)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("Unknown PROXY header version %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL: the proxy's own connection, not one it's passing on
+		return nil, nil
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets or unspecified, so no IP address to record
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY header addresses too short")
+	}
+	ip := net.IP(body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// Sends header then "play\n" down a pipe, and reads the header off the other end.
+// The caller should close the returned end of the pipe, which is the sending end.
+func readTestProxyHeader(header []byte) (net.Conn, net.Conn, error) {
+	conn, other := net.Pipe()
+	go other.Write(append(header, "play\n"...))
+	proxied, err := readProxyHeader(conn)
+	return proxied, other, err
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, PROXY_V2_SIGNATURE...)
+	v2 = append(v2, 0x21, 0x11, 0, 12) // PROXY, TCP over IPv4, 12 bytes of addresses
+	v2 = append(v2, 192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x05, 0x47)
+
+	local := append([]byte{}, PROXY_V2_SIGNATURE...)
+	local = append(local, 0x20, 0, 0, 0)
+
+	cases := []struct {
+		header []byte
+		addr   string // "" to keep the pipe's
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 1351\r\n"), "192.0.2.1:12345"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 1351\r\n"), "[2001:db8::1]:12345"},
+		{[]byte("PROXY UNKNOWN\r\n"), ""},
+		{v2, "192.0.2.1:12345"},
+		{local, ""},
+	}
+	for _, c := range cases {
+		conn, other, err := readTestProxyHeader(c.header)
+		defer other.Close()
+		if err != nil {
+			t.Errorf("TestReadProxyHeader: %q returned err (%s)", c.header, err.Error())
+			continue
+		}
+		want := c.addr
+		if want == "" {
+			want = "pipe"
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("TestReadProxyHeader: %q gave address %s, want %s", c.header, got, want)
+		}
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "play\n" {
+			t.Errorf("TestReadProxyHeader: %q left %q to read, want %q", c.header, line, "play\n")
+		}
+	}
+}
+
+func TestReadProxyHeaderBad(t *testing.T) {
+	for _, header := range []string{
+		"play and no header\n",
+		"PROXY TCP4 nonsense\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 123456 1351\r\n",
+	} {
+		_, other, err := readTestProxyHeader([]byte(header))
+		other.Close()
+		if err == nil {
+			t.Errorf("TestReadProxyHeaderBad: %q accepted, want err", header)
+		}
+	}
+}
+
+// Clients connecting through a proxy go by the address in the header, in logs and everywhere.
+func TestClientRemoteAddrProxied(t *testing.T) {
+	proxied, other, err := readTestProxyHeader([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 1351\r\n"))
+	if err != nil {
+		t.Fatalf("TestClientRemoteAddrProxied: returned err reading header (%s)", err.Error())
+	}
+	defer other.Close()
+	c := &Client{id: 1, conn: proxied}
+	if addr := c.RemoteAddr().String(); addr != "192.0.2.1:40000" {
+		t.Errorf("TestClientRemoteAddrProxied: got %s, want 192.0.2.1:40000", addr)
+	}
+	if s := c.String(); s != "#1 192.0.2.1:40000" {
+		t.Errorf("TestClientRemoteAddrProxied: String got %q, want %q", s, "#1 192.0.2.1:40000")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// A token bucket rate limiter. Tokens refill at rate per second up to burst, and each allowed
+// event takes one, or as many as it's worth. Not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Makes a token bucket that starts full.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Adds the tokens that have come in since the last refill.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Takes a token if there is one, returning whether the event is allowed.
+func (b *tokenBucket) allow() bool {
+	return b.allowN(1)
+}
+
+// Takes n tokens if there are that many, returning whether the event is allowed. An event worth
+// more than burst is allowed once the bucket is full, leaving it in debt, so it isn't refused
+// forever, but still waits its turn.
+func (b *tokenBucket) allowN(n float64) bool {
+	b.refill()
+	if b.tokens < n && b.tokens < b.burst {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Gets how long until an event worth n tokens would be allowed.
+func (b *tokenBucket) waitN(n float64) time.Duration {
+	b.refill()
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
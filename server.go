@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+// Server is a listd instance: a hub, and what it takes to start and stop it from outside,
+// whether that's main or another program embedding listd.
+type Server struct {
+	h *hub
+
+	// Cancelled by Shutdown, which then waits for done to be closed by ListenAndServe.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Makes a hub for cfg, logging to logger and connecting to the downstream service with dial.
+// The hub is not connected to anything yet.
+func initHub(cfg *Config, logger Logger, dial dialFunc) *hub {
+	downstream := &connector{name: "playout", dial: dial}
+	h := &hub{
+		clients:        make(map[*Client]bool),
+		clientsPerAddr: make(map[string]int),
+		lockouts:       make(map[string]time.Time),
+
+		config:    cfg,
+		reloadCh:  make(chan *Config),
+		logger:    logger,
+		listening: make(chan struct{}),
+
+		downstreamState: *baps3.InitServiceState(),
+
+		pl:            InitPlaylist(),
+		latency:       initLatencyTracker(),
+		tags:          initTagTracker(),
+		responseCache: make(map[string]baps3.Message),
+		middleware:    append([]Middleware(nil), DEFAULT_MIDDLEWARE...),
+		featuresOff:   make(map[string]bool),
+
+		downstream: downstream,
+		connectors: []*connector{downstream},
+		routes:     make(map[baps3.MessageWord]*connector),
+		downResCh:  make(chan connectorResponse),
+		connCh:     make(chan downstreamConn),
+
+		reqCh: make(chan clientAndMessage, cfg.ChannelBuffer),
+
+		addCh: make(chan *Client, cfg.ChannelBuffer),
+		rmCh:  make(chan *Client, cfg.ChannelBuffer),
+	}
+	h.sharedConfig.Store(cfg)
+	return h
+}
+
+// Changes how a Server is set up, overriding its config. Given to InitServer.
+type ServerOption func(*Server)
+
+// Limits how many clients can be connected at once.
+func WithMaxClients(n int) ServerOption {
+	return func(s *Server) { s.h.config.MaxClients = n }
+}
+
+// Disconnects clients that send nothing for d. 0 disables this.
+func WithReadTimeout(d time.Duration) ServerOption {
+	return func(s *Server) { s.h.config.ReadTimeout.Duration = d }
+}
+
+// Sends log messages to l, instead of the standard log package.
+func WithLogger(l Logger) ServerOption {
+	return func(s *Server) { s.h.logger = l }
+}
+
+// Serves TLS, with the certificate/key pair in certFile and keyFile.
+func WithTLS(certFile string, keyFile string) ServerOption {
+	return func(s *Server) { s.h.config.CertFile, s.h.config.KeyFile = certFile, keyFile }
+}
+
+// Advertises the server as name and version in the OHAI, instead of listd's own.
+func WithServerName(name string, version string) ServerOption {
+	return func(s *Server) { s.h.config.ServerName, s.h.config.ServerVersion = name, version }
+}
+
+// Sends requests with the given command words to another downstream service called name,
+// connected to with dial, instead of the playout system. Its responses are broadcast to clients
+// along with the playout system's. If a word is given for more than one connector, the last wins.
+func WithConnector(name string, dial dialFunc, commands ...string) ServerOption {
+	return func(s *Server) {
+		words := make([]baps3.MessageWord, len(commands))
+		for i, cmd := range commands {
+			words[i] = baps3.LookupWord(cmd)
+		}
+		s.h.addConnector(name, dial, words)
+	}
+}
+
+// Runs the server without a playout system, in mode (one of STANDALONE_MODES), as described for
+// Config.Standalone. InitServer's dial is then never used, so can be nil.
+func WithStandalone(mode string) ServerOption {
+	return func(s *Server) { s.h.config.Standalone = mode }
+}
+
+// Sends events about clients connecting, disconnecting and being kicked to ch, whenever it has
+// room for them; see events.go.
+func WithEvents(ch chan<- Event) ServerOption {
+	return func(s *Server) { s.h.events = ch }
+}
+
+// Adds m to the end of the chain of middleware requests go through, after listd's own (see
+// middleware.go). Middleware is run in the order it's added.
+func WithMiddleware(m Middleware) ServerOption {
+	return func(s *Server) { s.h.middleware = append(s.h.middleware, m) }
+}
+
+// Makes a Server for cfg, which should already be validated, or for defaultConfig if cfg is nil.
+// dial is how the server connects to the downstream service. opts are applied in order, on top of
+// cfg; cfg itself isn't changed. Without WithLogger, log messages go to the standard log package.
+func InitServer(cfg *Config, dial dialFunc, opts ...ServerOption) *Server {
+	if cfg == nil {
+		cfg = defaultConfig()
+	} else {
+		copied := *cfg
+		cfg = &copied
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		h:      initHub(cfg, newStdLogger(cfg.logLevel), dial),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Connects to the downstream services, then listens for and serves clients as configured.
+// Blocks until Shutdown is called, returning nil, or until connecting or listening fails.
+func (s *Server) ListenAndServe() error {
+	defer close(s.done)
+	cfg := s.h.config
+	if err := validateBind(cfg.Addr, cfg.Port); err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.CertFile != "" {
+		var err error
+		if tlsConfig, err = loadTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile); err != nil {
+			return fmt.Errorf("Error loading TLS certificate: %s", err)
+		}
+	}
+
+	if cfg.AccessLog != "" {
+		var err error
+		if s.h.accessLog, err = openAccessLog(cfg.AccessLog, cfg.AccessLogFormat); err != nil {
+			return fmt.Errorf("Error opening access log: %s", err)
+		}
+		defer s.h.accessLog.Close()
+	}
+
+	if cfg.DebugAddr != "" {
+		debug, err := startHTTPServer("profiles", cfg.DebugAddr, debugHandler(), s.h.logger)
+		if err != nil {
+			return fmt.Errorf("Error starting debug server: %s", err)
+		}
+		defer debug.Close()
+	}
+	if cfg.HealthAddr != "" {
+		health, err := startHTTPServer("health checks", cfg.HealthAddr, healthHandler(s), s.h.logger)
+		if err != nil {
+			return fmt.Errorf("Error starting health server: %s", err)
+		}
+		defer health.Close()
+	}
+
+	if cfg.Standalone != "" {
+		s.h.logger.Info("Running standalone, in", cfg.Standalone, "mode")
+	} else if err := s.dialConnectors(); err != nil {
+		return err
+	}
+
+	if err := s.h.runListener(s.ctx, cfg, tlsConfig); err != nil {
+		return fmt.Errorf("Listening error: %s", err)
+	}
+	return nil
+}
+
+// Connects to every downstream service. If any can't be connected to, those that were are
+// disconnected again.
+func (s *Server) dialConnectors() error {
+	for _, conn := range s.h.connectors {
+		reqCh, resCh, err := conn.dial()
+		if err != nil {
+			s.h.closeConnectors()
+			if conn == s.h.downstream {
+				return fmt.Errorf("Error connecting to playout system: %s", err)
+			}
+			return fmt.Errorf("Error connecting to %s: %s", conn, err)
+		}
+		conn.reqCh, conn.resCh = reqCh, resCh
+	}
+	return nil
+}
+
+// Gets the address the server is listening on, waiting until it is, so clients can find it
+// when it was given port 0 to pick any free one. Returns nil if ListenAndServe gives up first.
+func (s *Server) Addr() net.Addr {
+	select {
+	case <-s.h.listening:
+		return s.h.addr
+	case <-s.done:
+		return nil
+	}
+}
+
+// Stops the server, closing every connection, and waits for ListenAndServe to return, which it
+// only does once every goroutine serving clients and connectors has (see hub.connWg), so nothing
+// is left running. Gives up waiting, returning ctx's error, if ctx is done first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Switches the running server to cfg, without dropping anyone, as described for hub.reloadConfig.
+// Options given to InitServer aren't reapplied. If cfg isn't valid, the old config is kept and
+// the validation error returned. cfg itself is left alone, and the caller is free to go on using
+// it; the server works on a copy, as validating and reloading fill in and carry over fields.
+func (s *Server) Reload(cfg *Config) error {
+	c := *cfg
+	if err := c.validate(); err != nil {
+		return err
+	}
+	select {
+	case s.h.reloadCh <- &c:
+	case <-s.done:
+	}
+	return nil
+}
+
+// Gets how many downstream responses have taken each of LATENCY_BUCKETS' times or less, plus
+// (last) how many took longer. Safe to call from any goroutine.
+func (s *Server) LatencyCounts() []uint64 {
+	return s.h.latency.hist.Counts()
+}
+
+// Starts or stops draining: refusing new clients while serving those already connected, as
+// before a restart. Safe to call from any goroutine.
+func (s *Server) Drain(on bool) {
+	s.h.setDraining(on)
+}
+
+// Gets how many clients are currently connected. Safe to call from any goroutine.
+func (s *Server) ClientCount() int {
+	return s.h.ClientCount()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestServerShutdown(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	dial := func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		return make(chan baps3.Message), make(chan baps3.Message), nil
+	}
+	s := InitServer(cfg, dial)
+
+	done := make(chan error)
+	go func() { done <- s.ListenAndServe() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("TestServerShutdown: returned err on shutdown (%s)", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Errorf("TestServerShutdown: ListenAndServe returned err (%s), want nil", err.Error())
+	}
+}
+
+// Clients connected when the server shuts down are told so before being disconnected.
+func TestServerShutdownGoodbye(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	go s.ListenAndServe()
+
+	addr := s.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("TestServerShutdownGoodbye: returned err dialling %s (%s)", addr, err.Error())
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "OHAI") {
+		t.Fatalf("TestServerShutdownGoodbye: got %q (%v), want an OHAI", line, err)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("TestServerShutdownGoodbye: returned err on shutdown (%s)", err.Error())
+	}
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		last = line
+	}
+	if last != "FAIL 'Shutting down'\n" {
+		t.Errorf("TestServerShutdownGoodbye: last line %q, want the goodbye", last)
+	}
+}
+
+// By the time Shutdown returns, every goroutine the server started has returned too.
+func TestServerShutdownWaits(t *testing.T) {
+	const numClients = 10
+	before := runtime.NumGoroutine()
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	go s.ListenAndServe()
+
+	addr := s.Addr()
+	for i := 0; i < numClients; i++ {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("TestServerShutdownWaits: returned err dialling %s (%s)", addr, err.Error())
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("TestServerShutdownWaits: returned err on read (%s)", err.Error())
+		}
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("TestServerShutdownWaits: returned err on shutdown (%s)", err.Error())
+	}
+	// Allow for the goroutine running ListenAndServe, which may not have finished returning
+	if after := runtime.NumGoroutine(); after > before+1 {
+		t.Errorf("TestServerShutdownWaits: %d goroutines after shutdown, want at most %d", after, before+1)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	cfg := defaultConfig()
+	s := InitServer(cfg, nil, WithMaxClients(5), WithReadTimeout(time.Minute), WithServerName("test", "1.0"))
+
+	if s.h.config.MaxClients != 5 {
+		t.Errorf("TestServerOptions: max clients %d, want 5", s.h.config.MaxClients)
+	}
+	if s.h.config.ReadTimeout.Duration != time.Minute {
+		t.Errorf("TestServerOptions: read timeout %s, want 1m", s.h.config.ReadTimeout.Duration)
+	}
+	if ohai, _ := s.h.makeRsOhai().Arg(0); !strings.HasPrefix(ohai, "test 1.0/") {
+		t.Errorf("TestServerOptions: OHAI %q, want it to start %q", ohai, "test 1.0/")
+	}
+	if cfg.MaxClients == 5 {
+		t.Errorf("TestServerOptions: options changed the given config")
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	dial := func() (chan<- baps3.Message, <-chan baps3.Message, error) {
+		return make(chan baps3.Message), make(chan baps3.Message), nil
+	}
+	s := InitServer(cfg, dial)
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+
+	bad := defaultConfig()
+	bad.MaxClients = 0
+	if err := s.Reload(bad); err == nil {
+		t.Errorf("TestServerReload: invalid config reloaded, want err")
+	}
+
+	next := defaultConfig()
+	next.Port, next.MaxClients = "1352", 7
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("TestServerReload: returned err on reload (%s)", err.Error())
+	}
+	for i := 0; s.h.currentConfig().MaxClients != 7; i++ {
+		if i == 100 {
+			t.Fatalf("TestServerReload: max clients %d after reload, want 7", s.h.currentConfig().MaxClients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if port := s.h.currentConfig().Port; port != "0" {
+		t.Errorf("TestServerReload: port %s after reload, want it kept as 0", port)
+	}
+	if next.Port != "1352" || s.h.currentConfig() == next {
+		t.Errorf("TestServerReload: reloading changed the given config")
+	}
+}
+
+func TestServerStandalone(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+
+	done := make(chan error)
+	go func() { done <- s.ListenAndServe() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("TestServerStandalone: returned err on shutdown (%s)", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Errorf("TestServerStandalone: ListenAndServe returned err (%s), want nil", err.Error())
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = "0"
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+
+	addr := s.Addr()
+	if addr == nil {
+		t.Fatalf("TestServerAddr: no address, want the one listened on")
+	}
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("TestServerAddr: returned err dialling %s (%s)", addr, err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || !strings.HasPrefix(line, "OHAI") {
+		t.Errorf("TestServerAddr: got %q (%v), want an OHAI", line, err)
+	}
+}
+
+// A bad port is caught before anything is started.
+func TestServerBadPort(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Port = ""
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "port is empty") {
+		t.Errorf("TestServerBadPort: got err %v, want one saying the port is empty", err)
+	}
+}
+
+func TestServerAddrFailed(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Addr = "256.0.0.1"
+	s := InitServer(cfg, nil, WithStandalone("echo"))
+	go s.ListenAndServe()
+
+	if addr := s.Addr(); addr != nil {
+		t.Errorf("TestServerAddrFailed: got %s, want nil for a server that couldn't listen", addr)
+	}
+}
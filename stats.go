@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+//
+// Stats
+//
+// With Config.StatsInterval set, listd logs a line summarising what it's been doing every
+// interval, so small deployments can keep an eye on it without a metrics stack:
+//
+//   Stats: 3 clients, 17 accepted, 250 requests forwarded, 9001 responses broadcast, 2 dropped
+//
+// Everything but the clients is a running total since runListener started.
+//
+
+// A snapshot of a server's stats.
+type Stats struct {
+	// How many clients are connected.
+	Clients int
+	// How many clients have been accepted, including those since gone.
+	Accepted uint64
+	// How many requests have been passed on to connectors.
+	Forwarded uint64
+	// How many responses have been broadcast to every client.
+	Broadcast uint64
+	// How many responses have been dropped for clients not keeping up.
+	Dropped uint64
+}
+
+// The hub's running totals. Only ever accessed atomically.
+type hubCounts struct {
+	accepted  uint64
+	forwarded uint64
+	broadcast uint64
+	dropped   uint64
+}
+
+// Gets a snapshot of the hub's stats. Safe to call from any goroutine.
+func (h *hub) stats() Stats {
+	return Stats{
+		Clients:   h.ClientCount(),
+		Accepted:  atomic.LoadUint64(&h.counts.accepted),
+		Forwarded: atomic.LoadUint64(&h.counts.forwarded),
+		Broadcast: atomic.LoadUint64(&h.counts.broadcast),
+		Dropped:   atomic.LoadUint64(&h.counts.dropped),
+	}
+}
+
+// Logs the hub's stats.
+func (h *hub) logStats() {
+	s := h.stats()
+	h.logger.Info("Stats:", s.Clients, "clients,", s.Accepted, "accepted,", s.Forwarded, "requests forwarded,",
+		s.Broadcast, "responses broadcast,", s.Dropped, "dropped")
+}
+
+// Gets a snapshot of the server's stats. Safe to call from any goroutine.
+func (s *Server) Stats() Stats {
+	return s.h.stats()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestStats(t *testing.T) {
+	h := makeTestHub()
+	h.config.MaxDropped = 10
+	h.setConnector(make(chan baps3.Message, 1), make(chan baps3.Message))
+
+	conn, other := net.Pipe()
+	defer other.Close()
+	joined := &Client{
+		id:        nextClientID(),
+		connected: time.Now(),
+		conn:      conn,
+		logger:    h.logger,
+		resCh:     make(chan response, 100),
+		lowCh:     make(chan response, 100),
+	}
+	h.addClient(joined)
+
+	// Nothing ever reads the stuck client's resCh, so everything it's sent is dropped
+	stuck := &Client{id: nextClientID(), resCh: make(chan response)}
+	h.clients[stuck] = true
+
+	h.broadcast(*baps3.NewMessage(baps3.RsCount).AddArg("1"))
+	h.broadcastResponse(*baps3.NewMessage(baps3.RsCount).AddArg("2"))
+	h.sendDownstreamFor(nil, "", *baps3.NewMessage(baps3.RqPlay))
+
+	want := Stats{Clients: 1, Accepted: 1, Forwarded: 1, Broadcast: 2, Dropped: 2}
+	// The stuck client went behind addClient's back, so isn't counted
+	if got := h.stats(); got != want {
+		t.Errorf("TestStats: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+//
+// Request tags
+//
+// A client can tag a request by starting its line with '@<tag>', as in '@7 play'. Responses are
+// broadcast, so without a tag a client can't tell whether an 'OK play' answers its own play or
+// someone else's. The acknowledgement (OK, FAIL or WHAT) answering a tagged request goes only to
+// the client that sent it, starting with the same tag: '@7 OK play'. Anything else the request
+// causes, such as a STATE change, is still broadcast untagged, as is every response to untagged
+// requests. Responses to local requests only go to the client that sent them anyway, so their
+// tags are ignored.
+//
+// As with latency (see latency.go), acknowledgements are matched to requests by the request word
+// they name, taking the oldest outstanding request with that word. Untagged requests are tracked
+// too, so they're matched to their own acknowledgements rather than taking someone else's.
+//
+// Requests not acknowledged within RequestTimeout are given up on. If they were tagged, the
+// client that sent them is sent '@<tag> FAIL "Timed out" <request>' instead.
+//
+
+// Longest tag a client may send.
+const MAX_TAG_LENGTH = 32
+
+// Checks whether tag (without its '@') is made only of letters, digits, - and _, and isn't too long.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > MAX_TAG_LENGTH {
+		return false
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits the tag off the words of a request line, if it has one. ok is false if there is a tag,
+// but it isn't valid.
+func splitTag(line []string) (tag string, rest []string, ok bool) {
+	if len(line) == 0 || len(line[0]) == 0 || line[0][0] != '@' {
+		return "", line, true
+	}
+	tag = line[0][1:]
+	return tag, line[1:], validTag(tag) && len(line) > 1
+}
+
+// Packs a response to a tagged request, starting it with the tag.
+func packTagged(tag string, res baps3.Message) (response, error) {
+	packed, err := packResponse(res)
+	packed.packed = append([]byte("@"+tag+" "), packed.packed...)
+	return packed, err
+}
+
+// A request sent downstream, and who sent it with what tag ("" if none). c is nil for listd's
+// own requests.
+type taggedRequest struct {
+	c    *Client
+	tag  string
+	req  baps3.Message
+	sent time.Time
+}
+
+// Tracks requests sent downstream until they are acknowledged. Only used from within
+// runListener's loop.
+type tagTracker struct {
+	// The outstanding requests, oldest first, by request word.
+	pending map[baps3.MessageWord][]taggedRequest
+}
+
+func initTagTracker() *tagTracker {
+	return &tagTracker{pending: make(map[baps3.MessageWord][]taggedRequest)}
+}
+
+// Records that req has just been sent downstream for c, tagged with tag.
+func (tt *tagTracker) sent(c *Client, tag string, req baps3.Message) {
+	tt.pending[req.Word()] = append(tt.pending[req.Word()], taggedRequest{c, tag, req, time.Now()})
+}
+
+// Forgets, and returns, every outstanding request sent more than timeout ago, as they're assumed
+// never to be acknowledged.
+func (tt *tagTracker) expire(timeout time.Duration) (expired []taggedRequest) {
+	for word, sent := range tt.pending {
+		i := 0
+		for i < len(sent) && time.Since(sent[i].sent) > timeout {
+			i++
+		}
+		expired = append(expired, sent[:i]...)
+		if i == len(sent) {
+			delete(tt.pending, word)
+		} else {
+			tt.pending[word] = sent[i:]
+		}
+	}
+	return
+}
+
+// Matches res, if it is an acknowledgement, with the oldest outstanding request it answers.
+// ok is false if it doesn't answer a request that was tagged.
+func (tt *tagTracker) received(res baps3.Message) (c *Client, tag string, ok bool) {
+	word, isAck := answeredWord(res)
+	if !isAck {
+		return nil, "", false
+	}
+	sent := tt.pending[word]
+	if len(sent) == 0 {
+		return nil, "", false
+	}
+	tt.pending[word] = sent[1:]
+	return sent[0].c, sent[0].tag, sent[0].tag != ""
+}
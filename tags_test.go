@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	baps3 "github.com/UniversityRadioYork/baps3-go"
+)
+
+func TestSplitTag(t *testing.T) {
+	cases := []struct {
+		line []string
+		tag  string
+		rest []string
+		ok   bool
+	}{
+		{[]string{"play"}, "", []string{"play"}, true},
+		{[]string{"@7", "play"}, "7", []string{"play"}, true},
+		{[]string{"@my-tag_2", "seek", "1000"}, "my-tag_2", []string{"seek", "1000"}, true},
+		{[]string{"@", "play"}, "", nil, false},
+		{[]string{"@bad'tag", "play"}, "", nil, false},
+		{[]string{"@7"}, "", nil, false},
+	}
+	for _, c := range cases {
+		tag, rest, ok := splitTag(c.line)
+		if ok != c.ok || (ok && (tag != c.tag || !reflect.DeepEqual(rest, c.rest))) {
+			t.Errorf("TestSplitTag: %q split into %q %q (%v), want %q %q (%v)", c.line, tag, rest, ok, c.tag, c.rest, c.ok)
+		}
+	}
+}
+
+// One tagged and one untagged play: each gets the acknowledgement meant for it.
+func TestTaggedResponses(t *testing.T) {
+	h := makeTestHub()
+	h.setConnector(make(chan baps3.Message, 2), make(chan baps3.Message))
+	tagged, taggedOther := makeTestClient(h)
+	defer taggedOther.Close()
+	untagged, untaggedOther := makeTestClient(h)
+	defer untaggedOther.Close()
+
+	h.processRequest(tagged, *baps3.NewMessage(baps3.RqPlay), "7")
+	h.processRequest(untagged, *baps3.NewMessage(baps3.RqPlay), "")
+
+	h.processResponse(h.downstream, *baps3.NewMessage(baps3.RsOk).AddArg("play"))
+	if res := <-tagged.resCh; string(res.packed) != "@7 OK play\n" {
+		t.Errorf("TestTaggedResponses: tagged client got %q, want %q", res.packed, "@7 OK play\n")
+	}
+	if n := len(untagged.resCh); n != 0 {
+		t.Fatalf("TestTaggedResponses: tagged acknowledgement sent to another client")
+	}
+
+	h.processResponse(h.downstream, *baps3.NewMessage(baps3.RsOk).AddArg("play"))
+	for _, c := range []*Client{tagged, untagged} {
+		if res := <-c.resCh; string(res.packed) != "OK play\n" {
+			t.Errorf("TestTaggedResponses: %v got %q, want %q", c, res.packed, "OK play\n")
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	h := makeTestHub()
+	h.config.RequestTimeout.Duration = time.Millisecond
+	h.setConnector(make(chan baps3.Message, 1), make(chan baps3.Message))
+	c, other := makeTestClient(h)
+	defer other.Close()
+
+	h.processRequest(c, *baps3.NewMessage(baps3.RqPlay), "7")
+	time.Sleep(5 * time.Millisecond)
+	h.expireRequests()
+
+	res := <-c.resCh
+	if res.String() != "FAIL Timed out play" || !strings.HasPrefix(string(res.packed), "@7 ") {
+		t.Errorf("TestRequestTimeout: got %q, want a FAIL tagged @7", res.packed)
+	}
+	if len(h.tags.pending[baps3.RqPlay]) != 0 {
+		t.Errorf("TestRequestTimeout: timed out request still pending")
+	}
+}